@@ -0,0 +1,236 @@
+package codegen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/is-hoku/pl0dash-go/getsource"
+)
+
+// アセンブラの 1 行の命令語、ラベルは全部の行を読んでから決める
+type asmLine struct {
+	line     int      // 行番号
+	op       OpCode   // 命令
+	operands []string // オペランド
+}
+
+// テキストの目的プログラムをアセンブルする、 name はエラーとデバッグ情報に使うファイル名
+// 1 行に「ラベル: 命令 オペランド, ...」を書き、 ; から行末は注釈、行頭の番地 (disasm の出力) は読み飛ばす
+// 疑似命令 .source 名前, .frame display|static, .entry ラベル, .func 名前 レベル パラメタ数 フレームの大きさ
+func Assemble(r io.Reader, name string) (*Program, error) {
+	p := &Program{Source: name}
+	labels := make(map[string]int) // ラベルの番地
+	var insts []asmLine
+	entry := ""
+	fail := func(line int, m string) error {
+		return errors.New(fmt.Sprintf("%s:%d: %s", name, line, m))
+	}
+	define := func(line int, l string) error {
+		if _, ok := labels[l]; ok {
+			return fail(line, fmt.Sprintf("duplicate label %s", l))
+		}
+		labels[l] = len(insts)
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if i := strings.Index(text, ";"); i >= 0 { // 注釈
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], ".") { // 疑似命令
+			args := fields[1:]
+			switch fields[0] {
+			case ".source":
+				if len(args) != 1 {
+					return nil, fail(n, ".source needs a file name")
+				}
+				p.Source = args[0]
+			case ".frame":
+				f, ok := ParseFrame(strings.Join(args, " "))
+				if !ok {
+					return nil, fail(n, fmt.Sprintf("unknown frame %q", strings.Join(args, " ")))
+				}
+				p.Frame = f
+			case ".entry":
+				if len(args) != 1 {
+					return nil, fail(n, ".entry needs a label")
+				}
+				entry = args[0]
+			case ".func":
+				if len(args) != 4 {
+					return nil, fail(n, ".func needs a name, level, pars and frame size")
+				}
+				f := Func{Name: args[0], Addr: len(insts)}
+				var err error
+				for i, v := range []*int{&f.Level, &f.Pars, &f.Size} {
+					if *v, err = strconv.Atoi(args[i+1]); err != nil {
+						return nil, fail(n, fmt.Sprintf("invalid number %q", args[i+1]))
+					}
+				}
+				if err := define(n, f.Name); err != nil {
+					return nil, err
+				}
+				p.Funcs = append(p.Funcs, f)
+			default:
+				return nil, fail(n, fmt.Sprintf("unknown directive %s", fields[0]))
+			}
+			continue
+		}
+		rest := strings.TrimSpace(text)
+		for { // 行頭のラベル
+			i := strings.Index(rest, ":")
+			if i < 0 || strings.ContainsAny(rest[:i], " \t,") {
+				break
+			}
+			if err := define(n, rest[:i]); err != nil {
+				return nil, err
+			}
+			rest = strings.TrimSpace(rest[i+1:])
+		}
+		fields = strings.Fields(rest)
+		if len(fields) > 0 {
+			if _, err := strconv.Atoi(fields[0]); err == nil { // disasm の出力の番地
+				fields = fields[1:]
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		op, ok := parseOpCode(fields[0])
+		if !ok {
+			return nil, fail(n, fmt.Sprintf("unknown instruction %s", fields[0]))
+		}
+		var operands []string
+		if s := strings.TrimSpace(strings.Join(fields[1:], " ")); s != "" {
+			for _, o := range strings.Split(s, ",") {
+				operands = append(operands, strings.TrimSpace(o))
+			}
+		}
+		insts = append(insts, asmLine{n, op, operands})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// ラベルが決まったので命令語にする
+	for _, l := range insts {
+		c, err := assembleInst(l, labels)
+		if err != nil {
+			return nil, fail(l.line, err.Error())
+		}
+		p.Code = append(p.Code, c)
+		p.Pos = append(p.Pos, SrcPos{name, getsource.Pos{Line: l.line}})
+	}
+	if len(p.Code) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: no instructions", name))
+	}
+	if entry != "" {
+		a, err := target(entry, labels)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: .entry: %s", name, err))
+		}
+		p.Entry = a
+	}
+	return p, nil
+}
+
+// 1 行の命令語のオペランドを読む
+func assembleInst(l asmLine, labels map[string]int) (Inst, error) {
+	c := Inst{Op: l.op}
+	want := 0 // オペランドの数
+	var err error
+	nums := func(vs ...*int) {
+		for i, v := range vs {
+			if err == nil && i < len(l.operands) {
+				*v, err = strconv.Atoi(l.operands[i])
+			}
+		}
+	}
+	switch l.op {
+	case Lit, Ict, Jix:
+		want = 1
+		nums(&c.Value)
+	case Opr:
+		want = 1
+		if len(l.operands) > 0 {
+			var ok bool
+			if c.Optr, ok = parseOperator(l.operands[0]); !ok {
+				return c, errors.New(fmt.Sprintf("unknown operator %s", l.operands[0]))
+			}
+		}
+	case Lod, Sto, Lda, Ret:
+		want = 2
+		nums(&c.Addr.Level, &c.Addr.Addr)
+	case Ldx, Stx, Lax: // 4 番目の添字の下限は省略できる
+		want = 3
+		if len(l.operands) == 4 {
+			want = 4
+		}
+		nums(&c.Addr.Level, &c.Addr.Addr, &c.Value, &c.Low)
+	case Cal:
+		want = 2
+		nums(&c.Addr.Level)
+		if err == nil && len(l.operands) == 2 {
+			c.Addr.Addr, err = target(l.operands[1], labels)
+		}
+	case Jmp, Jpc:
+		want = 1
+		if len(l.operands) == 1 {
+			c.Value, err = target(l.operands[0], labels)
+		}
+	}
+	if len(l.operands) != want {
+		return c, errors.New(fmt.Sprintf("%s needs %d operands", l.op, want))
+	}
+	if err != nil {
+		return c, errors.New(fmt.Sprintf("invalid operand: %s", err))
+	}
+	return c, nil
+}
+
+// 飛び先、ラベルか番地
+func target(s string, labels map[string]int) (int, error) {
+	if a, ok := labels[s]; ok {
+		return a, nil
+	}
+	if a, err := strconv.Atoi(s); err == nil {
+		return a, nil
+	}
+	return 0, errors.New(fmt.Sprintf("undefined label %s", s))
+}
+
+func parseOpCode(s string) (OpCode, bool) {
+	for o := Lit; o <= Sti; o++ {
+		if o.String() == s {
+			return o, true
+		}
+	}
+	return 0, false
+}
+
+func parseOperator(s string) (Operator, bool) {
+	for o := Neg; o <= Dup; o++ {
+		if o.String() == s {
+			return o, true
+		}
+	}
+	return 0, false
+}
+
+// 名前 s のフレームの形式
+func ParseFrame(s string) (Frame, bool) {
+	for _, f := range []Frame{DisplayFrame, StaticLinkFrame} {
+		if f.String() == s {
+			return f, true
+		}
+	}
+	return 0, false
+}
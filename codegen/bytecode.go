@@ -0,0 +1,284 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/is-hoku/pl0dash-go/getsource"
+)
+
+// 目的プログラムのファイル (.pl0c) の形式
+// MAGIC, 版 (2 バイト), フラグ (2 バイト) の後に可変長整数で
+// 文字列表、定数表、フレームの形式、開始番地、ソース、ブロックの情報、命令語、デバッグ情報 (フラグがあれば) が続き、
+// 最後にそれまでの CRC32 (4 バイト) を置く
+const MAGIC string = "PL0C"
+const FORMATVERSION uint16 = 2
+
+const debugFlag uint16 = 1 // デバッグ情報がある
+
+// data の先頭は目的プログラムのファイルの MAGIC か？
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(MAGIC))
+}
+
+// 目的プログラム p を w に書き出す、 debug ならデバッグ情報も
+func WriteProgram(w io.Writer, p *Program, debug bool) error {
+	var e encoder
+	e.strs = make(map[string]int)
+	e.consts = make(map[int]int)
+	// 文字列と定数は表に集めて、本体からはその番号で指す
+	var body []byte
+	body = e.uint(body, int(p.Frame))
+	body = e.uint(body, p.Entry)
+	body = e.uint(body, e.str(p.Source))
+	body = e.uint(body, len(p.Funcs))
+	for _, f := range p.Funcs {
+		body = e.uint(body, e.str(f.Name))
+		body = e.uint(body, f.Addr)
+		body = e.uint(body, f.Level)
+		body = e.uint(body, f.Pars)
+		body = e.uint(body, f.Size)
+	}
+	body = e.uint(body, len(p.Code))
+	for _, c := range p.Code {
+		body = append(body, byte(c.Op))
+		switch c.Op {
+		case Lit:
+			body = e.uint(body, e.konst(c.Value))
+		case Opr:
+			body = e.uint(body, int(c.Optr))
+		case Lod, Sto, Cal, Ret, Lda:
+			body = e.int(body, c.Addr.Level)
+			body = e.int(body, c.Addr.Addr)
+		case Ldx, Stx, Lax:
+			body = e.int(body, c.Addr.Level)
+			body = e.int(body, c.Addr.Addr)
+			body = e.int(body, c.Value)
+			body = e.int(body, c.Low)
+		case Ict, Jmp, Jpc, Jix:
+			body = e.int(body, c.Value)
+		}
+	}
+	var flags uint16
+	if debug && len(p.Pos) == len(p.Code) {
+		flags |= debugFlag
+		for _, s := range p.Pos {
+			body = e.uint(body, e.str(s.File))
+			body = e.uint(body, s.Pos.Line)
+			body = e.uint(body, s.Pos.Col)
+		}
+	}
+	out := []byte(MAGIC)
+	out = binary.LittleEndian.AppendUint16(out, FORMATVERSION)
+	out = binary.LittleEndian.AppendUint16(out, flags)
+	out = e.uint(out, len(e.strList))
+	for _, s := range e.strList {
+		out = e.uint(out, len(s))
+		out = append(out, s...)
+	}
+	out = e.uint(out, len(e.constList))
+	for _, v := range e.constList {
+		out = e.int(out, v)
+	}
+	out = append(out, body...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+	_, err := w.Write(out)
+	return err
+}
+
+// 目的プログラムのファイルの内容 data を読む
+func ReadProgram(data []byte) (*Program, error) {
+	if !IsBytecode(data) {
+		return nil, errors.New("not a PL/0 bytecode file")
+	}
+	if len(data) < len(MAGIC)+8 {
+		return nil, errors.New("corrupt bytecode file: too short")
+	}
+	if v := binary.LittleEndian.Uint16(data[len(MAGIC):]); v != FORMATVERSION {
+		return nil, errors.New(fmt.Sprintf("unsupported bytecode version %d (expected %d)", v, FORMATVERSION))
+	}
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return nil, errors.New("corrupt bytecode file: checksum mismatch")
+	}
+	d := decoder{data: data[:n], pos: len(MAGIC)}
+	flags := binary.LittleEndian.Uint16(data[d.pos+2:])
+	d.pos += 4
+	strs := make([]string, d.count())
+	for i := range strs {
+		l := d.count()
+		if d.err == nil {
+			strs[i] = string(d.data[d.pos : d.pos+l])
+			d.pos += l
+		}
+	}
+	consts := make([]int, d.count())
+	for i := range consts {
+		consts[i] = d.int()
+	}
+	str := func() string {
+		i := d.uint()
+		if i >= len(strs) {
+			d.fail("string index out of range")
+			return ""
+		}
+		return strs[i]
+	}
+	p := &Program{}
+	p.Frame = Frame(d.uint())
+	p.Entry = d.uint()
+	p.Source = str()
+	p.Funcs = make([]Func, d.count())
+	for i := range p.Funcs {
+		p.Funcs[i] = Func{Name: str(), Addr: d.uint(), Level: d.uint(), Pars: d.uint(), Size: d.uint()}
+	}
+	p.Code = make([]Inst, d.count())
+	for i := range p.Code {
+		c := &p.Code[i]
+		c.Op = OpCode(d.byte())
+		switch c.Op {
+		case Lit:
+			k := d.uint()
+			if k >= len(consts) {
+				d.fail("constant index out of range")
+				break
+			}
+			c.Value = consts[k]
+		case Opr:
+			c.Optr = Operator(d.uint())
+			if c.Optr > Dup {
+				d.fail(fmt.Sprintf("unknown operator %d at %d", c.Optr, i))
+			}
+		case Lod, Sto, Cal, Ret, Lda:
+			c.Addr.Level = d.int()
+			c.Addr.Addr = d.int()
+		case Ldx, Stx, Lax:
+			c.Addr.Level = d.int()
+			c.Addr.Addr = d.int()
+			c.Value = d.int()
+			c.Low = d.int()
+		case Ict, Jmp, Jpc, Jix:
+			c.Value = d.int()
+		case Ldi, Sti:
+		default:
+			d.fail(fmt.Sprintf("unknown opcode %d at %d", c.Op, i))
+		}
+	}
+	if flags&debugFlag != 0 {
+		p.Pos = make([]SrcPos, len(p.Code))
+		for i := range p.Pos {
+			p.Pos[i] = SrcPos{str(), getsource.Pos{Line: d.uint(), Col: d.uint()}}
+		}
+	}
+	if d.err == nil && d.pos != len(d.data) {
+		d.fail("trailing data")
+	}
+	if d.err == nil && (p.Frame > StaticLinkFrame || p.Entry >= len(p.Code)) {
+		d.fail("invalid header")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+// 目的プログラムを書くときの文字列表と定数表
+type encoder struct {
+	strs      map[string]int // 文字列から表の番号へ
+	strList   []string
+	consts    map[int]int // 定数から表の番号へ
+	constList []int
+}
+
+// 文字列 s の表の番号
+func (e *encoder) str(s string) int {
+	i, ok := e.strs[s]
+	if !ok {
+		i = len(e.strList)
+		e.strs[s] = i
+		e.strList = append(e.strList, s)
+	}
+	return i
+}
+
+// 定数 v の表の番号
+func (e *encoder) konst(v int) int {
+	i, ok := e.consts[v]
+	if !ok {
+		i = len(e.constList)
+		e.consts[v] = i
+		e.constList = append(e.constList, v)
+	}
+	return i
+}
+
+func (e *encoder) uint(b []byte, v int) []byte {
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func (e *encoder) int(b []byte, v int) []byte {
+	return binary.AppendVarint(b, int64(v))
+}
+
+// 目的プログラムのファイルを読む位置、最初のエラーを覚えておく
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *decoder) fail(m string) {
+	if d.err == nil {
+		d.err = errors.New("corrupt bytecode file: " + m)
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.data) {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	d.pos++
+	return d.data[d.pos-1]
+}
+
+func (d *decoder) uint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 || v > math.MaxInt32 {
+		d.fail("malformed number")
+		return 0
+	}
+	d.pos += n
+	return int(v)
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("malformed number")
+		return 0
+	}
+	d.pos += n
+	return int(v)
+}
+
+// 個数や長さを読む、残りのデータより多ければエラー
+func (d *decoder) count() int {
+	v := d.uint()
+	if v > len(d.data)-d.pos {
+		d.fail("length out of range")
+		return 0
+	}
+	return v
+}
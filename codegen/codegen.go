@@ -1,22 +1,61 @@
 package codegen
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
+	"runtime"
 
 	"github.com/is-hoku/pl0dash-go/getsource"
 	"github.com/is-hoku/pl0dash-go/table"
 )
 
-const MAXCODE int = 200 // 目的コードの最大長さ
 const MAXMEM int = 2000 // 実行時スタックの最大長さ
 const MAXREG int = 20   // 演算レジスタスタックの最大長さ
-const MAXLEVEL int = 5  // ブロックの最大長さ
 
-var cIndex int = -1 // 最後に生成した命令語のインデックス
+var prog = &Program{}          // 生成中の目的プログラム
+var frame Frame = DisplayFrame // 関数呼び出しのフレームの形式
+var at *getsource.Pos          // 次に生成する命令語のソースの位置、 nil なら現トークンの位置
+var patched = -1               // 最後にバックパッチした飛び先の番地
 
+type Frame int // 外側のブロックの変数をたどる方式
+const (
+	DisplayFrame    Frame = iota // 各レベルのブロックの先頭番地をディスプレイに置く
+	StaticLinkFrame              // 各フレームに外側のブロックのフレームへの静的リンクを置く
+)
+
+func (f Frame) String() string {
+	switch f {
+	case DisplayFrame:
+		return "display"
+	case StaticLinkFrame:
+		return "static"
+	default:
+		return "unknown"
+	}
+}
+
+// フレームの形式を設定する、コンパイルの前に呼ぶ
+func SetFrame(f Frame) {
+	frame = f
+}
+
+// 各ブロックの最初の変数の番地
+// ディスプレイではフレームの先頭に退避したディスプレイと戻り番地、静的リンクでは静的リンク、動的リンク、戻り番地がある
+func FirstAddr() int {
+	if frame == StaticLinkFrame {
+		return 3
+	}
+	return 2
+}
+
+// 次に生成する命令語の番地
 func NextCode() int {
-	return cIndex + 1
+	return len(prog.Code)
 }
 
 type OpCode int // 命令語のコード
@@ -30,6 +69,13 @@ const (
 	Ict
 	Jmp
 	Jpc
+	Ldx
+	Stx
+	Jix
+	Lda
+	Lax
+	Ldi
+	Sti
 )
 
 func (o OpCode) String() string {
@@ -52,6 +98,20 @@ func (o OpCode) String() string {
 		return "jmp"
 	case Jpc:
 		return "jpc"
+	case Ldx:
+		return "ldx"
+	case Stx:
+		return "stx"
+	case Jix:
+		return "jix"
+	case Lda:
+		return "lda"
+	case Lax:
+		return "lax"
+	case Ldi:
+		return "ldi"
+	case Sti:
+		return "sti"
 	default:
 		return "unknown"
 	}
@@ -64,6 +124,8 @@ const (
 	Sub
 	Mul
 	Div
+	Mod
+	Pow
 	Odd
 	Eq
 	Ls
@@ -73,6 +135,9 @@ const (
 	Greq
 	Wrt
 	Wrl
+	Red
+	Rdl
+	Dup
 )
 
 func (o Operator) String() string {
@@ -87,6 +152,10 @@ func (o Operator) String() string {
 		return "mul"
 	case Div:
 		return "div"
+	case Mod:
+		return "mod"
+	case Pow:
+		return "pow"
 	case Odd:
 		return "odd"
 	case Eq:
@@ -105,128 +174,346 @@ func (o Operator) String() string {
 		return "wrt"
 	case Wrl:
 		return "wrl"
+	case Red:
+		return "red"
+	case Rdl:
+		return "rdl"
+	case Dup:
+		return "dup"
 	default:
 		return "unknown"
 	}
 }
 
 // 命令語の型
-type inst struct {
-	opCode OpCode
-	u      struct {
-		addr  getsource.RelAddr
-		value int
-		optr  Operator
+type Inst struct {
+	Op    OpCode
+	Addr  getsource.RelAddr // 名前のアドレス、 cal では呼ぶ関数、 ret ではブロックレベルとパラメタ数
+	Value int               // 定数や飛び先の番地、配列の要素数
+	Optr  Operator          // opr の演算命令
+	Low   int               // 配列の添字の下限 (エラーの添字をソースの値で示すため)
+}
+
+// 関数 (ブロック) の情報
+type Func struct {
+	Name  string // 関数名、主ブロックは main
+	Addr  int    // ブロックの主文の先頭番地 (ict 命令)
+	Level int    // ブロックレベル
+	Pars  int    // パラメタ数
+	Size  int    // 実行時のフレームの大きさ
+	ti    int    // 名前表の関数名のインデックス
+}
+
+// ソースの位置 (デバッグ情報)
+type SrcPos struct {
+	File string
+	Pos  getsource.Pos
+}
+
+// 目的プログラム
+type Program struct {
+	Code   []Inst   // 命令語
+	Entry  int      // 実行を始める番地
+	Frame  Frame    // 外側のブロックの変数をたどる方式
+	Funcs  []Func   // 各ブロックの情報 (主文を生成した順)
+	Source string   // ソースファイルの名前
+	Pos    []SrcPos // 各命令語を生成したときのトークンの位置、デバッグ情報がなければ nil
+}
+
+// 目的プログラムの生成を始める、フレームの形式は SetFrame で設定したもの
+func Begin(source string) {
+	prog = &Program{Frame: frame, Source: source}
+	at = nil
+	patched = -1
+}
+
+// 生成した目的プログラムを返す
+func End() *Program {
+	for i, f := range prog.Funcs {
+		if f.ti != 0 { // import した関数名は lib.name になっている
+			prog.Funcs[i].Name = table.RetName(f.ti)
+		}
+	}
+	return prog
+}
+
+// 名前表 [ti] の関数のブロックの主文の始まりで呼ばれる、 ti が 0 なら主ブロック
+func BeginFunc(ti int) {
+	f := Func{Name: "main", Addr: NextCode(), Level: table.BLevel(), Pars: table.FPars(), Size: table.RetFrameL(), ti: ti}
+	if ti == 0 {
+		prog.Entry = f.Addr
+	}
+	prog.Funcs = append(prog.Funcs, f)
+}
+
+// 命令語 c を生成してその番地を返す
+func emit(c Inst) int {
+	p := getsource.TokenPos()
+	if at != nil {
+		p, at = *at, nil
 	}
+	prog.Code = append(prog.Code, c)
+	prog.Pos = append(prog.Pos, SrcPos{getsource.FileName(), p})
+	return len(prog.Code) - 1
 }
 
-var code [MAXCODE]inst // 目的コードが入る
+// 次に生成する命令語のソースの位置を p にする
+// 演算や呼び出しの命令語は被演算子や実引数の後に生成するので、その演算子や関数名の位置を覚えておいて使う
+func SetPos(p getsource.Pos) {
+	at = &p
+}
 
 // 命令語の生成、アドレス部に v
 func GenCodeV(op OpCode, v int, fptex *os.File) int {
-	checkMax(fptex)
-	code[cIndex].opCode = op
-	code[cIndex].u.value = v
-	return cIndex
+	return emit(Inst{Op: op, Value: v})
 }
 
-// 命令語の生成、アドレス部に演算命令
+// 命令語の生成、アドレス部に名前表 [ti] のアドレス
 func GenCodeT(op OpCode, ti int, fptex *os.File) int {
-	checkMax(fptex)
-	code[cIndex].opCode = op
-	code[cIndex].u.addr = table.RetRelAddr(ti)
-	return cIndex
+	return emit(Inst{Op: op, Addr: relAddr(ti)})
+}
+
+// 配列の命令語の生成、アドレス部に配列の先頭番地、値に要素数
+func GenCodeA(op OpCode, ti int, fptex *os.File) int {
+	return emit(Inst{Op: op, Addr: relAddr(ti), Value: table.RetSize(ti), Low: table.RetLow(ti)}) // 要素数は添字の範囲検査用
+}
+
+// 名前表 [ti] の命令語でのアドレス
+// 静的リンクではレベルを今のブロックから静的リンクをたどる段数にする (cal では呼ばれる関数の静的リンクになるフレームまで)
+func relAddr(ti int) getsource.RelAddr {
+	a := table.RetRelAddr(ti)
+	if frame == StaticLinkFrame {
+		a.Level = table.BLevel() - a.Level
+	}
+	return a
 }
 
 // 命令語の生成、アドレス部に演算命令
 func GenCodeO(p Operator, fptex *os.File) int {
-	checkMax(fptex)
-	code[cIndex].opCode = Opr
-	code[cIndex].u.optr = p
-	return cIndex
+	return emit(Inst{Op: Opr, Optr: p})
 }
 
 // ret 命令語の生成
 func GenCodeR(fptex *os.File) int {
-	if code[cIndex].opCode == Ret { // 直前が ret なら生成せず
-		return cIndex
+	// 直前が ret なら生成しない、ただしここが飛び先なら (if の中の return の後など) 生成する
+	if n := len(prog.Code); n > 0 && prog.Code[n-1].Op == Ret && patched != n {
+		return n - 1
 	}
-	checkMax(fptex)
-	code[cIndex].opCode = Ret
-	code[cIndex].u.addr.Level = table.BLevel()
-	code[cIndex].u.addr.Addr = table.FPars() // パラメタ数 (実行スタックの解放用)
-	return cIndex
-}
-
-// 目的コードのインデックスの増加とチェック
-func checkMax(fptex *os.File) {
-	cIndex++
-	if cIndex < MAXCODE {
-		return
-	}
-	getsource.ErrorF("too many code", fptex)
+	return emit(Inst{Op: Ret, Addr: getsource.RelAddr{Level: table.BLevel(), Addr: table.FPars()}}) // パラメタ数は実行スタックの解放用
 }
 
 // 命令語のバックパッチ (次の番地を)
 func BackPatch(i int) {
-	code[i].u.value = cIndex + 1
-}
-
-// 目的コード (命令語) の実行
-func Execute(fptex *os.File) {
-	var stack [MAXMEM]int     // 実行時スタック
-	var display [MAXLEVEL]int // 現在見える各ブロックの先頭番地のディスプレイ
-	var pc, top, lev int
-	var i inst // 実行する命令語
-	fmt.Println("start execution")
-	top = 0        // 次にスタックに入れる場所
-	pc = 0         // 命令語のカウンタ
-	stack[0] = 0   // stack[top] は callee で壊すディスプレイの退避場所
-	stack[1] = 0   // stack[top+1] は caller への戻り番地
-	display[0] = 0 // 主ブロックの先頭番地は 0
+	prog.Code[i].Value = NextCode()
+	patched = NextCode()
+}
+
+// 命令語 [i] のアドレス部の番地の変更 (forward 宣言した関数の呼び出しのバックパッチ)
+func ChangeA(i int, a int) {
+	prog.Code[i].Addr.Addr = a
+}
+
+// 番地 from からの命令語のうち、番地 from を呼ぶ call 命令の呼び先を番地 to にする
+// (内部関数からの呼び出しが関数の先頭の jmp 命令でなく主文の先頭を呼ぶように)
+func ChangeCalls(from int, to int) {
+	for i := from; i < len(prog.Code); i++ {
+		if c := &prog.Code[i]; c.Op == Cal && c.Addr.Addr == from {
+			c.Addr.Addr = to
+		}
+	}
+}
+
+// ディスプレイの大きさ (目的コードに現れるブロックレベルの数)
+func displayLen(p *Program) int {
+	n := 1
+	for _, c := range p.Code {
+		l := c.Addr.Level + 1
+		if c.Op == Cal { // 呼ばれる関数のブロックは一つ深い
+			l++
+		}
+		if l > n {
+			n = l
+		}
+	}
+	return n
+}
+
+// 目的プログラムを実行する仮想機械
+type VM struct {
+	out io.Writer     // write 文の出力先
+	in  *bufio.Reader // read 文の入力元
+	log *log.Logger   // 実行の開始などの状態の出力先
+}
+
+// 仮想機械を作る、 log が nil なら状態は出力しない
+func NewVM(out io.Writer, in io.Reader, logger *log.Logger) *VM {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &VM{out: out, in: bufio.NewReader(in), log: logger}
+}
+
+// 目的プログラム p の実行、実行時エラーは *RuntimeError で返す
+func (vm *VM) Run(p *Program) (err error) {
+	var stack [MAXMEM]int // 実行時スタック
+	var display []int     // 現在見える各ブロックの先頭番地のディスプレイ
+	var pc, top, lev, b int
+	var i Inst                     // 実行する命令語
+	cur := p.Entry                 // 実行中の命令語の番地
+	calls := []call{{fn: p.Entry}} // 実行中の関数の呼び出し、先頭は主ブロック
+	fail := func(k ErrorKind, err error) error {
+		return runtimeError(p, k, cur, err, calls, stack[:])
+	}
+	defer func() { // 範囲外の番地の読み書きなど、個別に調べていないものは番地の誤りとする
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); !ok {
+				panic(r)
+			}
+			err = fail(InvalidAddress, nil)
+		}
+	}()
+	if p.Frame == DisplayFrame {
+		display = make([]int, displayLen(p))
+	}
+	// アドレス a の名前があるブロックの先頭番地
+	base := func(a getsource.RelAddr) int {
+		if p.Frame == DisplayFrame {
+			return display[a.Level]
+		}
+		f := b
+		for l := a.Level; l > 0; l-- { // 静的リンクを a.Level 段たどる
+			f = stack[f]
+		}
+		return f
+	}
+	vm.log.Println("start execution")
+	top = 0      // 次にスタックに入れる場所
+	pc = p.Entry // 命令語のカウンタ
+	b = 0        // 実行中のブロックの先頭番地 (静的リンクで使う)
+	stack[0] = 0 // stack[top] は callee で壊すディスプレイの退避場所 (静的リンクでは静的リンク)
+	stack[1] = 0 // stack[top+1] は caller への戻り番地 (静的リンクでは動的リンク)
+	stack[2] = 0 // 静的リンクでは stack[top+2] が戻り番地
+	if p.Frame == DisplayFrame {
+		display[0] = 0 // 主ブロックの先頭番地は 0
+	}
 	for {
-		i = code[pc] // これから実行する命令語
+		if pc < 0 || pc >= len(p.Code) { // 飛んだ命令語 cur のエラーにする
+			return fail(InvalidJump, fmt.Errorf("target %d is outside the code", pc))
+		}
+		cur = pc
+		i = p.Code[pc] // これから実行する命令語
 		pc++
-		switch i.opCode {
+		if top+3 > MAXMEM { // 1 命令で積むのは高々 3 語 (cal)
+			return fail(StackOverflow, nil)
+		}
+		floor := calls[len(calls)-1].sp // 実行中のフレームの局所変数より下は取り出せない
+		if i.Op == Ret {
+			floor = calls[len(calls)-1].base // 手続きと主ブロックの ret は返さない値を局所変数の領域から取り出す
+		}
+		if top-pops(i) < floor {
+			return fail(StackUnderflow, nil)
+		}
+		switch i.Op {
 		case Lit:
-			stack[top] = i.u.value
+			stack[top] = i.Value
 			top++
 		case Lod:
-			stack[top] = stack[display[i.u.addr.Level]+i.u.addr.Addr]
+			stack[top] = stack[base(i.Addr)+i.Addr.Addr]
 			top++
 		case Sto:
 			top--
-			stack[display[i.u.addr.Level]+i.u.addr.Addr] = stack[top]
+			stack[base(i.Addr)+i.Addr.Addr] = stack[top]
+		case Ldx: // スタックのトップにある添字 (0 から) の要素を読む
+			x := stack[top-1]
+			if x < 0 || x >= i.Value {
+				return fail(IndexOutOfRange, fmt.Errorf("index %d, range %d..%d", x+i.Low, i.Low, i.Low+i.Value-1))
+			}
+			stack[top-1] = stack[base(i.Addr)+i.Addr.Addr+x]
+		case Stx: // 添字 (0 から) と値をスタックから取り出して代入
+			top -= 2
+			x := stack[top]
+			if x < 0 || x >= i.Value {
+				return fail(IndexOutOfRange, fmt.Errorf("index %d, range %d..%d", x+i.Low, i.Low, i.Low+i.Value-1))
+			}
+			stack[base(i.Addr)+i.Addr.Addr+x] = stack[top+1]
 		case Cal:
-			// i.u.addr.Level は callee の名前のレベル、 callee のブロックのレベル lev はそれに +1 したもの
-			lev = i.u.addr.Level + 1
-			stack[top] = display[lev] // display[lev] の退避
-			stack[top+1] = pc
-			display[lev] = top // 現在の top が callee のブロックの先頭番地
-			pc = i.u.addr.Addr
+			if p.Frame == StaticLinkFrame {
+				// i.Addr.Level は callee の名前のあるブロックまでの段数、そのブロックが callee の静的リンク
+				stack[top] = base(i.Addr)
+				stack[top+1] = b // 動的リンク
+				stack[top+2] = pc
+				b = top // 現在の top が callee のブロックの先頭番地
+			} else {
+				// i.Addr.Level は callee の名前のレベル、 callee のブロックのレベル lev はそれに +1 したもの
+				lev = i.Addr.Level + 1
+				stack[top] = display[lev] // display[lev] の退避
+				stack[top+1] = pc
+				display[lev] = top // 現在の top が callee のブロックの先頭番地
+			}
+			calls = append(calls, call{fn: i.Addr.Addr, base: top, sp: top, from: cur})
+			pc = i.Addr.Addr
 		case Ret:
+			if len(calls) == 1 { // 主ブロックの ret で実行を終える
+				return nil
+			}
 			top--
-			temp := stack[top]                   // スタックのトップにあるものが返す値
-			top = display[i.u.addr.Level]        // top を呼ばれたときの値に戻す
-			display[i.u.addr.Level] = stack[top] // 壊したディスプレイの回復
-			pc = stack[top+1]
-			top -= i.u.addr.Addr // 実引数の分だけ top を戻す
-			stack[top] = temp    // 返す値をスタックの top へ
+			temp := stack[top] // スタックのトップにあるものが返す値
+			if p.Frame == StaticLinkFrame {
+				top = b           // top を呼ばれたときの値に戻す
+				b = stack[top+1]  // caller のブロックの先頭番地
+				pc = stack[top+2] // caller への戻り番地
+			} else {
+				top = display[i.Addr.Level]        // top を呼ばれたときの値に戻す
+				display[i.Addr.Level] = stack[top] // 壊したディスプレイの回復
+				pc = stack[top+1]
+			}
+			top -= i.Addr.Addr // 実引数の分だけ top を戻す
+			calls = calls[:len(calls)-1]
+			if top < calls[len(calls)-1].sp {
+				return fail(StackUnderflow, nil)
+			}
+			stack[top] = temp // 返す値をスタックの top へ
 			top++
 		case Ict:
-			top += i.u.value
+			top += i.Value
 			if top >= MAXMEM-MAXREG {
-				getsource.ErrorF("stack overflow", fptex)
+				return fail(StackOverflow, nil)
+			}
+			if c := &calls[len(calls)-1]; cur == c.fn { // 関数の先頭の ict で局所変数の領域を取る
+				c.sp = top
+			}
+			if top < calls[len(calls)-1].sp {
+				return fail(StackUnderflow, nil)
 			}
 		case Jmp:
-			pc = i.u.value
+			pc = i.Value
 		case Jpc:
 			top--
 			if stack[top] == 0 {
-				pc = i.u.value
+				pc = i.Value
+			}
+		case Lda: // 変数の番地を積む
+			stack[top] = base(i.Addr) + i.Addr.Addr
+			top++
+		case Lax: // スタックのトップにある添字 (0 から) の要素の番地にする
+			x := stack[top-1]
+			if x < 0 || x >= i.Value {
+				return fail(IndexOutOfRange, fmt.Errorf("index %d, range %d..%d", x+i.Low, i.Low, i.Low+i.Value-1))
+			}
+			stack[top-1] = base(i.Addr) + i.Addr.Addr + x
+		case Ldi: // スタックのトップにある番地の値にする
+			stack[top-1] = stack[stack[top-1]]
+		case Sti: // 番地と値をスタックから取り出して代入
+			top -= 2
+			stack[stack[top]] = stack[top+1]
+		case Jix: // 後に続く i.Value 個の飛び先表の x 番目へ、範囲外なら表の後へ
+			if x := stack[top-1]; x >= 0 && x < i.Value {
+				pc += x
+			} else {
+				pc += i.Value
 			}
 		case Opr:
-			switch i.u.optr {
+			switch i.Optr {
 			case Neg:
 				stack[top-1] = -stack[top-1]
 				continue
@@ -244,8 +531,29 @@ func Execute(fptex *os.File) {
 				continue
 			case Div:
 				top--
+				if stack[top] == 0 {
+					return fail(DivByZero, nil)
+				}
 				stack[top-1] /= stack[top]
 				continue
+			case Mod:
+				top--
+				if stack[top] == 0 {
+					return fail(DivByZero, nil)
+				}
+				stack[top-1] %= stack[top] // 剰余の符号は被除数と同じ (div は 0 方向に切り捨て)
+				continue
+			case Pow:
+				top--
+				if stack[top-1] == 0 && stack[top] < 0 { // 0 の負のべき
+					return fail(DivByZero, nil)
+				}
+				stack[top-1] = power(stack[top-1], stack[top])
+				continue
+			case Dup:
+				stack[top] = stack[top-1]
+				top++
+				continue
 			case Odd:
 				stack[top-1] = stack[top-1] & 1 // 奇数判定のための論理積演算
 				continue
@@ -275,17 +583,107 @@ func Execute(fptex *os.File) {
 				continue
 			case Wrt:
 				top--
-				fmt.Printf("%d ", stack[top])
+				fmt.Fprintf(vm.out, "%d ", stack[top])
 				continue
 			case Wrl:
-				fmt.Println("")
+				fmt.Fprintln(vm.out)
+				continue
+			case Red:
+				v, err := vm.readInt()
+				if err != nil {
+					return fail(InputError, err)
+				}
+				stack[top] = v
+				top++
+				continue
+			case Rdl:
+				if _, err := vm.in.ReadString('\n'); err != nil && err != io.EOF {
+					return fail(InputError, err)
+				}
 				continue
 			}
 		}
-		if pc == 0 {
+	}
+}
+
+// 命令語 c が使うスタックのトップの語の数 (取り出さずに読み書きするものも含む)
+func pops(c Inst) int {
+	switch c.Op {
+	case Sto, Ldx, Ret, Jpc, Lax, Ldi, Jix:
+		return 1
+	case Stx, Sti:
+		return 2
+	case Opr:
+		switch c.Optr {
+		case Neg, Dup, Odd, Wrt:
+			return 1
+		case Wrl, Red, Rdl:
+			return 0
+		default:
+			return 2
+		}
+	default:
+		return 0
+	}
+}
+
+// 入力から空白で区切られた整数を 1 つ読む
+func (vm *VM) readInt() (int, error) {
+	var c byte
+	var err error
+	for { // 空白や改行を読み飛ばす
+		if c, err = vm.in.ReadByte(); err != nil {
+			return 0, errors.New("unexpected end of input")
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
 			break
 		}
 	}
+	sign := 1
+	if c == '-' || c == '+' {
+		if c == '-' {
+			sign = -1
+		}
+		if c, err = vm.in.ReadByte(); err != nil {
+			return 0, errors.New("unexpected end of input")
+		}
+	}
+	if c < '0' || c > '9' {
+		return 0, fmt.Errorf("malformed integer input: %q", c)
+	}
+	v := 0
+	for ; err == nil && c >= '0' && c <= '9'; c, err = vm.in.ReadByte() {
+		d := int(c - '0')
+		if v > (math.MaxInt-d)/10 { // 桁あふれ
+			return 0, errors.New("integer out of range")
+		}
+		v = 10*v + d
+	}
+	if err == nil {
+		vm.in.UnreadByte() // 数字の次の文字は読み戻す
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return 0, fmt.Errorf("malformed integer input: %q", c)
+		}
+	}
+	return sign * v, nil
+}
+
+// 整数のべき乗 b**e 、指数が負なら 1/b**(-e) を 0 方向に切り捨てた値
+func power(b int, e int) int {
+	if e < 0 {
+		if b == -1 && e&1 == 0 {
+			return 1
+		}
+		return 1 / b // b が 1 か -1 以外なら 0 (b が 0 なら 0 除算、 Run が先に調べる)
+	}
+	r := 1
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			r *= b
+		}
+		b *= b
+	}
+	return r
 }
 
 func bool2int(b bool) int {
@@ -0,0 +1,251 @@
+package codegen
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 関数呼び出しと下限のある配列を使うプログラム (disasm の出力)
+const callAsm = `.source q.pl0
+.frame display
+.entry main
+     0  jmp  main
+     1  jmp  f
+.func f 1 2 2
+     2  ict  2
+     3  lod  1, -2
+     4  lod  1, -1
+     5  opr  div
+     6  ret  1, 2
+.func main 0 0 5
+     7  ict  5
+     8  lit  1
+     9  lit  1
+    10  opr  sub
+    11  lit  7
+    12  lit  2
+    13  cal  0, f
+    14  stx  0, 2, 3, 1
+    15  lit  1
+    16  lit  1
+    17  opr  sub
+    18  ldx  0, 2, 3, 1
+    19  opr  wrt
+    20  lit  1
+    21  lit  0
+    22  cal  0, f
+    23  opr  wrt
+    24  ret  0, 0
+`
+
+// アセンブラ src をアセンブルして input を入力に実行した出力を返す
+func runAsm(t *testing.T, src string, input string) (string, error) {
+	t.Helper()
+	p, err := Assemble(strings.NewReader(src), "prog.pl0s")
+	if err != nil {
+		t.Fatalf("assemble: %s", err)
+	}
+	var out bytes.Buffer
+	err = NewVM(&out, strings.NewReader(input), nil).Run(p)
+	return out.String(), err
+}
+
+func TestRunAsm(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		input string
+		want  string
+	}{
+		{
+			name: "loop",
+			src: `.entry start
+start:  ict 3
+        lit 1
+        sto 0, 2
+loop:   lod 0, 2
+        lit 3
+        opr lseq
+        jpc done
+        lod 0, 2
+        opr wrt
+        lod 0, 2
+        lit 1
+        opr add
+        sto 0, 2
+        jmp loop
+done:   ret 0, 0
+`,
+			want: "1 2 3 ",
+		},
+		{
+			name:  "read",
+			src:   "ict 3\nopr red\nopr red\nopr add\nopr wrt\nret 0, 0\n",
+			input: "3 4\n",
+			want:  "7 ",
+		},
+		{
+			name:  "read the largest integer",
+			src:   "ict 3\nopr red\nopr red\nopr add\nopr wrt\nret 0, 0\n",
+			input: "9223372036854775807 -9223372036854775807\n",
+			want:  "0 ",
+		},
+		{
+			// 番地 0 に飛んでも終わらない、終わるのは主ブロックの ret
+			name: "jump to 0",
+			src: `.entry start
+again:  lod 0, 2
+        opr wrt
+        lod 0, 2
+        lit 1
+        opr sub
+        sto 0, 2
+        lod 0, 2
+        jpc done
+        jmp again
+start:  ict 3
+        lit 3
+        sto 0, 2
+        jmp again
+done:   ret 0, 0
+`,
+			want: "3 2 1 ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runAsm(t, tt.src, tt.input)
+			if err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		input string
+		kind  ErrorKind
+		msg   string   // Error() の最初の行
+		funcs []string // 呼び出しの列の関数名 (内側のものが先)
+	}{
+		{
+			name:  "division by zero",
+			src:   callAsm,
+			kind:  DivByZero,
+			msg:   "runtime error at 5 (prog.pl0s:10:1): division by zero",
+			funcs: []string{"f", "main"},
+		},
+		{
+			name: "index out of range",
+			src:  "ict 5\nlit 4\nldx 0, 2, 3, 1\nret 0, 0\n",
+			kind: IndexOutOfRange,
+			msg:  "runtime error at 2 (prog.pl0s:3:1): array index out of range: index 5, range 1..3",
+		},
+		{
+			name: "stack underflow",
+			src:  "ict 3\nopr add\nret 0, 0\n",
+			kind: StackUnderflow,
+		},
+		{
+			name: "invalid jump",
+			src:  "ict 3\njmp 99\n",
+			kind: InvalidJump,
+		},
+		{
+			name:  "input error",
+			src:   "ict 3\nopr red\nret 0, 0\n",
+			input: "x\n",
+			kind:  InputError,
+		},
+		{
+			name:  "input out of range",
+			src:   "ict 3\nopr red\nret 0, 0\n",
+			input: "99999999999999999999999\n",
+			kind:  InputError,
+			msg:   "runtime error at 1 (prog.pl0s:2:1): input error: integer out of range",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runAsm(t, tt.src, tt.input)
+			var e *RuntimeError
+			if !errors.As(err, &e) {
+				t.Fatalf("got %v, want a runtime error", err)
+			}
+			if e.Kind != tt.kind {
+				t.Errorf("got kind %s, want %s", e.Kind, tt.kind)
+			}
+			if msg := strings.Split(e.Error(), "\n")[0]; tt.msg != "" && msg != tt.msg {
+				t.Errorf("got %q, want %q", msg, tt.msg)
+			}
+			var funcs []string
+			for _, f := range e.Stack {
+				funcs = append(funcs, f.Func)
+			}
+			if tt.funcs != nil && !reflect.DeepEqual(funcs, tt.funcs) {
+				t.Errorf("got calls %v, want %v", funcs, tt.funcs)
+			}
+		})
+	}
+}
+
+// 目的プログラムのファイルに書いて読み直すと、同じプログラムになる
+func TestBytecode(t *testing.T) {
+	p, err := Assemble(strings.NewReader(callAsm), "q.pl0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, debug := range []bool{true, false} {
+		buf.Reset()
+		if err := WriteProgram(&buf, p, debug); err != nil {
+			t.Fatal(err)
+		}
+		if !IsBytecode(buf.Bytes()) {
+			t.Fatalf("debug %v: not a bytecode file", debug)
+		}
+		q, err := ReadProgram(buf.Bytes())
+		if err != nil {
+			t.Fatalf("debug %v: %s", debug, err)
+		}
+		want := *p
+		if !debug {
+			want.Pos = nil
+		}
+		if !reflect.DeepEqual(*q, want) {
+			t.Errorf("debug %v: got %+v, want %+v", debug, *q, want)
+		}
+	}
+	if _, err := ReadProgram(buf.Bytes()[:buf.Len()/2]); err == nil {
+		t.Error("read a truncated file without errors")
+	}
+}
+
+// 逆アセンブルした出力をアセンブルすると、同じ命令語になる
+func TestDisasm(t *testing.T) {
+	p, err := Assemble(strings.NewReader(callAsm), "q.pl0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	Disasm(&out, p, false)
+	if out.String() != callAsm {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), callAsm)
+	}
+	q, err := Assemble(&out, "q.pl0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(q.Code, p.Code) || !reflect.DeepEqual(q.Funcs, p.Funcs) || q.Entry != p.Entry || q.Frame != p.Frame || q.Source != p.Source {
+		t.Errorf("got %+v, want %+v", *q, *p)
+	}
+}
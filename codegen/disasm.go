@@ -0,0 +1,102 @@
+package codegen
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 目的プログラム p を命令語ごとに番地、命令、オペランドの順で w に出力する
+// 飛び先と呼び出し先はラベル (関数は関数名) で示す、 src ならソースの行を注釈として挟む
+func Disasm(w io.Writer, p *Program, src bool) {
+	labels := labelsOf(p)
+	funcs := make(map[int]Func)
+	for _, f := range p.Funcs {
+		funcs[f.Addr] = f
+	}
+	fmt.Fprintf(w, ".source %s\n", p.Source)
+	fmt.Fprintf(w, ".frame %s\n", p.Frame)
+	fmt.Fprintf(w, ".entry %s\n", labels[p.Entry])
+	lines := make(map[string][]string) // ソースファイルの行
+	var last SrcPos                    // 最後に出力したソースの行
+	for i, c := range p.Code {
+		if src && i < len(p.Pos) && (p.Pos[i].File != last.File || p.Pos[i].Pos.Line != last.Pos.Line) {
+			last = p.Pos[i]
+			if _, ok := lines[last.File]; !ok {
+				data, _ := os.ReadFile(last.File) // 読めなければ行は出さない
+				lines[last.File] = strings.Split(string(data), "\n")
+			}
+			if l := lines[last.File]; last.Pos.Line >= 1 && last.Pos.Line <= len(l) {
+				fmt.Fprintf(w, "; %s:%d: %s\n", last.File, last.Pos.Line, strings.TrimRight(l[last.Pos.Line-1], "\r"))
+			}
+		}
+		if f, ok := funcs[i]; ok {
+			fmt.Fprintf(w, ".func %s %d %d %d\n", labels[i], f.Level, f.Pars, f.Size)
+		} else if l, ok := labels[i]; ok {
+			fmt.Fprintf(w, "%s:\n", l)
+		}
+		fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("%6d  %-5s%s", i, c.Op, operands(c, labels)), " "))
+	}
+}
+
+// 命令語 c のオペランド
+func operands(c Inst, labels map[int]string) string {
+	switch c.Op {
+	case Lit, Ict, Jix:
+		return fmt.Sprintf("%d", c.Value)
+	case Opr:
+		return c.Optr.String()
+	case Lod, Sto, Lda, Ret:
+		return fmt.Sprintf("%d, %d", c.Addr.Level, c.Addr.Addr)
+	case Ldx, Stx, Lax: // 添字の下限は 0 でなければ書く
+		if c.Low != 0 {
+			return fmt.Sprintf("%d, %d, %d, %d", c.Addr.Level, c.Addr.Addr, c.Value, c.Low)
+		}
+		return fmt.Sprintf("%d, %d, %d", c.Addr.Level, c.Addr.Addr, c.Value)
+	case Cal:
+		return fmt.Sprintf("%d, %s", c.Addr.Level, label(c.Addr.Addr, labels))
+	case Jmp, Jpc:
+		return label(c.Value, labels)
+	default:
+		return ""
+	}
+}
+
+// 番地 a のラベル、なければ番地そのもの
+func label(a int, labels map[int]string) string {
+	if l, ok := labels[a]; ok {
+		return l
+	}
+	return fmt.Sprintf("%d", a)
+}
+
+// 飛び先と呼び出し先の番地のラベル、関数の先頭は関数名 (同じ名前があれば name@番地)、それ以外は L番地
+func labelsOf(p *Program) map[int]string {
+	labels := make(map[int]string)
+	used := make(map[string]bool)
+	for _, f := range p.Funcs {
+		name := f.Name
+		if used[name] {
+			name = fmt.Sprintf("%s@%d", f.Name, f.Addr)
+		}
+		used[name] = true
+		labels[f.Addr] = name
+	}
+	for _, c := range p.Code {
+		a := -1
+		switch c.Op {
+		case Jmp, Jpc:
+			a = c.Value
+		case Cal:
+			a = c.Addr.Addr
+		}
+		if _, ok := labels[a]; a >= 0 && !ok {
+			labels[a] = fmt.Sprintf("L%d", a)
+		}
+	}
+	if _, ok := labels[p.Entry]; !ok {
+		labels[p.Entry] = fmt.Sprintf("L%d", p.Entry)
+	}
+	return labels
+}
@@ -0,0 +1,138 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ErrorKind int // 実行時エラーの種類
+const (
+	DivByZero ErrorKind = iota
+	StackOverflow
+	StackUnderflow
+	InvalidJump
+	InvalidAddress
+	IndexOutOfRange
+	InputError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case DivByZero:
+		return "division by zero"
+	case StackOverflow:
+		return "stack overflow"
+	case StackUnderflow:
+		return "stack underflow"
+	case InvalidJump:
+		return "invalid jump"
+	case InvalidAddress:
+		return "invalid memory access"
+	case IndexOutOfRange:
+		return "array index out of range"
+	case InputError:
+		return "input error"
+	default:
+		return "unknown"
+	}
+}
+
+// 実行中の関数の呼び出しの 1 段
+type CallFrame struct {
+	Func string // 関数名
+	PC   int    // 実行中の番地 (呼び出し元では cal 命令の番地)
+	Pos  SrcPos // その番地の命令語を生成したソースの位置、デバッグ情報がなければ空
+	Args []int  // 実引数の値 (参照渡しは変数の番地)
+}
+
+const maxTrace = 20 // Error で出力する呼び出しの列の最大の長さ
+
+// 実行時エラー
+type RuntimeError struct {
+	Kind  ErrorKind
+	PC    int         // エラーになった命令語の番地
+	Pos   SrcPos      // その命令語を生成したソースの位置、デバッグ情報がなければ空
+	Stack []CallFrame // 呼び出しの列 (内側のものが先)
+	Err   error       // 入力のエラーなどの詳しい理由、なければ nil
+}
+
+func (e *RuntimeError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("runtime error at %d%s: %s", e.PC, posString(e.Pos), e.Kind))
+	if e.Err != nil {
+		sb.WriteString(fmt.Sprintf(": %s", e.Err))
+	}
+	for j, f := range e.Stack {
+		if n := len(e.Stack); n > maxTrace && j >= maxTrace/2 && j < n-maxTrace/2 { // 深い再帰は間を省く
+			if j == maxTrace/2 {
+				sb.WriteString(fmt.Sprintf("\n\t... %d more calls", n-maxTrace))
+			}
+			continue
+		}
+		args := make([]string, len(f.Args))
+		for i, a := range f.Args {
+			args[i] = fmt.Sprintf("%d", a)
+		}
+		sb.WriteString(fmt.Sprintf("\n\t%s(%s) at %d%s", f.Func, strings.Join(args, ", "), f.PC, posString(f.Pos)))
+	}
+	return sb.String()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// ソースの位置 " (file:行:桁)"、なければ空
+func posString(s SrcPos) string {
+	if s.File == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s:%d:%d)", s.File, s.Pos.Line, s.Pos.Col+1)
+}
+
+// 実行中の関数の呼び出し (実行時スタックとは別に仮想機械が覚えておく)
+type call struct {
+	fn   int // 呼ばれた関数の先頭番地
+	base int // フレームの先頭番地
+	sp   int // 局所変数の後の、式の計算に使う部分の先頭番地
+	from int // 呼び出した cal 命令の番地
+}
+
+// 番地 pc の命令語で起きた種類 k の実行時エラー、 calls と stack から呼び出しの列を作る
+func runtimeError(p *Program, k ErrorKind, pc int, err error, calls []call, stack []int) *RuntimeError {
+	e := &RuntimeError{Kind: k, PC: pc, Pos: srcPos(p, pc), Err: err}
+	funcs := make(map[int]Func)
+	for _, f := range p.Funcs {
+		funcs[f.Addr] = f
+	}
+	for j := len(calls) - 1; j >= 0; j-- {
+		c := calls[j]
+		f := CallFrame{PC: pc}
+		if j < len(calls)-1 {
+			f.PC = calls[j+1].from
+		}
+		f.Pos = srcPos(p, f.PC)
+		fn, ok := funcs[c.fn]
+		switch {
+		case ok:
+			f.Func = fn.Name
+		case j == 0:
+			f.Func = "main"
+		default:
+			f.Func = fmt.Sprintf("L%d", c.fn)
+		}
+		if ok && fn.Pars > 0 && c.base-fn.Pars >= 0 && c.base <= len(stack) {
+			f.Args = append(f.Args, stack[c.base-fn.Pars:c.base]...)
+		}
+		e.Stack = append(e.Stack, f)
+	}
+	return e
+}
+
+// 番地 pc の命令語のソースの位置
+func srcPos(p *Program, pc int) SrcPos {
+	if pc >= 0 && pc < len(p.Pos) {
+		return p.Pos[pc]
+	}
+	return SrcPos{}
+}
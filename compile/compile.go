@@ -4,37 +4,147 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/is-hoku/pl0dash-go/codegen"
 	"github.com/is-hoku/pl0dash-go/getsource"
 	"github.com/is-hoku/pl0dash-go/table"
 )
 
-const MINERROR int = 3    // エラーがこれ以下なら実行
-const FIRSTADDR int = 2   // 各ブロックの最初の変数のアドレス
-var token getsource.Token // 次のトークンを入れておく
+const MAXJUMP int = 1024 // case 文の飛び先表の最大の大きさ
 
-func Compile(fptex *os.File, scanner *bufio.Scanner) error {
-	fmt.Println("start compilation")
-	getsource.InitSource(fptex)                 // getsource の初期設定
-	token = getsource.NextToken(scanner, fptex) // 最初のトークン
-	table.BlockBegin(FIRSTADDR, fptex)          // これ以後の宣言は新しいブロックのもの
-	block(0, scanner, fptex)                    // 0 はダミー (主ブロックの関数名はない)
+var token getsource.Token                    // 次のトークンを入れておく
+var loops []*loop                            // コンパイル中の while 文 (内側のものが最後)
+var fwdCalls = make(map[int][]int)           // 本体がまだない関数の call 命令 (関数名のインデックスごと、バックパッチ用)
+var imported = make(map[string]*table.Scope) // import したファイル (絶対パス) の名前空間
+var importing []string                       // コンパイル中のファイル (循環する import の検出用)
+var syncs []keySet                           // 構文エラーからの回復で読み捨てを止める記号 (内側の構文のものが最後)
+
+// break, continue のための while 文の情報
+type loop struct {
+	start  int   // continue の飛び先 (条件式の先頭番地)
+	breaks []int // break の jmp 命令 (バックパッチ用)
+}
+
+// 記号の集合
+type keySet map[getsource.KeyID]bool
+
+func newSet(ks ...getsource.KeyID) keySet {
+	s := make(keySet)
+	for _, k := range ks {
+		s[k] = true
+	}
+	return s
+}
+
+// 集合 s と t の和集合
+func (s keySet) union(t keySet) keySet {
+	u := make(keySet)
+	for k := range s {
+		u[k] = true
+	}
+	for k := range t {
+		u[k] = true
+	}
+	return u
+}
+
+// 構文の FIRST 集合と FOLLOW 集合
+var firstDecl = newSet(getsource.Const, getsource.Var, getsource.Func, getsource.Proc, getsource.Import)
+var firstStatement = newSet(getsource.Id, getsource.If, getsource.Begin, getsource.Ret, getsource.While,
+	getsource.Write, getsource.WriteLn, getsource.Call, getsource.Read, getsource.ReadLn, getsource.Case,
+	getsource.Break, getsource.Continue, getsource.Exit)
+var followStatement = newSet(getsource.Semicolon, getsource.End, getsource.Else, getsource.Period)
+var firstFactor = newSet(getsource.Id, getsource.Num, getsource.Lparen, getsource.True, getsource.False)
+var followFactor = newSet(getsource.Rparen, getsource.Rbracket, getsource.Comma, getsource.Colon,
+	getsource.Semicolon, getsource.End, getsource.Then, getsource.Do, getsource.Of, getsource.Else, getsource.Period,
+	getsource.Equal, getsource.NotEq, getsource.Lss, getsource.Gtr, getsource.LssEq, getsource.GtrEq,
+	getsource.And, getsource.Or, getsource.Plus, getsource.Minus, getsource.Mult, getsource.Div,
+	getsource.IDiv, getsource.Mod, getsource.Power)
+
+// 構文 (の残り) をコンパイルする間、その後に来るはずの記号の集合 s を回復点にする
+func pushSync(s keySet) {
+	syncs = append(syncs, s)
+}
+
+func popSync() {
+	syncs = syncs[:len(syncs)-1]
+}
+
+// 記号 k はコンパイル中のどれかの構文の回復点か？
+func inSync(k getsource.KeyID) bool {
+	for _, s := range syncs {
+		if s[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// 集合 s の記号か回復点まで読み捨てる、読み捨てた記号の列は 1 つのエラー
+func skipTo(s keySet, scanner *bufio.Scanner, fptex *os.File) {
+	for !s[token.Kind] && !inSync(token.Kind) {
+		getsource.ErrorDelete(fptex)
+		token = getsource.NextToken(scanner, fptex)
+	}
+}
+
+// token が k なら次のトークンを読む、そうでなければ getsource.CheckGet で修復する
+// ただし回復点や文・宣言の先頭の記号は読み捨てずに k を挿入する
+func checkGet(k getsource.KeyID, scanner *bufio.Scanner, fptex *os.File) {
+	if token.Kind != k && (inSync(token.Kind) || firstStatement[token.Kind] || firstDecl[token.Kind]) {
+		getsource.ErrorInsert(k, fptex)
+		return
+	}
+	token = getsource.CheckGet(token, k, scanner, fptex)
+}
+
+// ソースをコンパイルして目的プログラムを返す、エラーがあればその数をエラーとして返す
+// ファイルの終わりやエラーの多さでコンパイルを途中で終えたときは、目的プログラムは nil
+func Compile(fptex *os.File, scanner *bufio.Scanner) (prog *codegen.Program, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != getsource.ABORT {
+				panic(r)
+			}
+			prog, err = nil, errors.New(fmt.Sprintf("compilation aborted, the number of error is %d", getsource.ErrorN()))
+		}
+	}()
+	loops = nil // 前のコンパイルの状態は残さない
+	fwdCalls = make(map[int][]int)
+	imported = make(map[string]*table.Scope)
+	importing = nil
+	syncs = nil
+	getsource.ResetErrors()
+	table.Reset()
+	if abs, err := filepath.Abs(getsource.FileName()); err == nil {
+		importing = append(importing, abs)
+		defer func() { importing = importing[:len(importing)-1] }()
+	}
+	getsource.InitSource(fptex)                  // getsource の初期設定
+	codegen.Begin(getsource.FileName())          // 目的プログラムの生成を始める
+	token = getsource.NextToken(scanner, fptex)  // 最初のトークン
+	table.BlockBegin(codegen.FirstAddr(), fptex) // これ以後の宣言は新しいブロックのもの
+	pushSync(newSet(getsource.Period))
+	block(0, scanner, fptex) // 0 はダミー (主ブロックの関数名はない)
+	popSync()
 	getsource.FinalSource(fptex)
+	prog = codegen.End()
 	i := getsource.ErrorN() // エラーメッセージの個数
 	if i != 0 {
-		return errors.New(fmt.Sprintf("the number of error is %d", i))
-	}
-	if i < MINERROR {
-		return errors.New("too many errors")
+		return prog, errors.New(fmt.Sprintf("the number of error is %d", i))
 	}
-	return nil
+	return prog, nil
 }
 
 // pIndex はこのブロックの関数名のインデックス
 func block(pIndex int, scanner *bufio.Scanner, fptex *os.File) {
-	backP := codegen.GenCodeV(codegen.Jmp, 0, fptex) // 内部関数を飛び越す命令、後でバックパッチ
+	backP := codegen.GenCodeV(codegen.Jmp, 0, fptex)   // 内部関数を飛び越す命令、後でバックパッチ
+	pushSync(firstDecl.union(newSet(getsource.Begin))) // 宣言の中のエラーは次の宣言か主文の begin まで
 	for {
 		switch token.Kind { // 宣言部のコンパイルをくりかえす
 		case getsource.Const: // 定数宣言部
@@ -47,21 +157,133 @@ func block(pIndex int, scanner *bufio.Scanner, fptex *os.File) {
 			continue
 		case getsource.Func: // 関数宣言部
 			token = getsource.NextToken(scanner, fptex)
-			funcDecl(scanner, fptex)
+			funcDecl(getsource.FuncID, scanner, fptex)
+			continue
+		case getsource.Proc: // 手続き宣言部
+			token = getsource.NextToken(scanner, fptex)
+			funcDecl(getsource.ProcID, scanner, fptex)
+			continue
+		case getsource.Import: // import 宣言
+			importDecl(scanner, fptex)
 			continue
 		default:
 			break
 		}
 		break
 	}
+	popSync()
+	checkFwd(fptex)
+	// 内部関数からの呼び出しも、関数の先頭の jmp 命令でなく主文の先頭を呼ぶ
+	codegen.ChangeCalls(table.RetRelAddr(pIndex).Addr, codegen.NextCode())
 	codegen.BackPatch(backP)                                // 内部関数を飛び越す命令にパッチ
 	table.ChangeV(pIndex, codegen.NextCode())               // この関数の開始番地を修正
+	codegen.BeginFunc(pIndex)                               // ブロックの情報を目的プログラムに
 	codegen.GenCodeV(codegen.Ict, table.RetFrameL(), fptex) // このブロックの実行時の必要記憶域を取る命令
 	statement(scanner, fptex)                               // このブロックの主文
 	codegen.GenCodeR(fptex)                                 // リターン命令
 	table.BlockEnd()                                        // ブロックが終わったことを table に連絡
 }
 
+// このブロックで forward 宣言した関数には本体があるはず、エラーは宣言の順に出力する
+func checkFwd(fptex *os.File) {
+	fwds := make([]int, 0, len(fwdCalls))
+	for ti := range fwdCalls {
+		fwds = append(fwds, ti)
+	}
+	sort.Ints(fwds)
+	for _, ti := range fwds {
+		if table.RetRelAddr(ti).Level == table.BLevel() && ti > table.NamespaceStart() {
+			getsource.ErrorMessage(fmt.Sprintf("forward\\ %s", table.RetName(ti)), fptex)
+			delete(fwdCalls, ti)
+		}
+	}
+}
+
+// import 宣言のコンパイル、 token は import
+// import したファイルの主ブロックの定数と関数は、ファイル名を付けた lib.name で参照する
+func importDecl(scanner *bufio.Scanner, fptex *os.File) {
+	if table.BLevel() != 0 { // import は主ブロックにしか書けない
+		getsource.ErrorType("level", fptex)
+	}
+	token = getsource.NextToken(scanner, fptex)
+	if token.Kind == getsource.Str {
+		path := filepath.Join(filepath.Dir(getsource.FileName()), token.U.ID)
+		abs, _ := filepath.Abs(path)
+		for _, f := range importing {
+			if f == abs { // コンパイル中のファイルを import した
+				getsource.ErrorType("cycle", fptex)
+				imported[abs] = nil
+				break
+			}
+		}
+		if ns, ok := imported[abs]; ok {
+			if ns != nil { // 別のファイルが import 済みなら名前を見えるようにするだけ
+				table.UseNamespace(ns)
+			}
+		} else if !compileLibrary(path, abs) {
+			getsource.ErrorType("cannot open", fptex)
+		}
+		token = getsource.NextToken(scanner, fptex)
+	} else {
+		getsource.ErrorType("file", fptex)
+	}
+	checkGet(getsource.Semicolon, scanner, fptex) // 最後は ; のはず
+}
+
+// import したファイルのコンパイル、エラーはそのファイルの .tex ファイルに出力する
+// 開けなければ false を返す
+func compileLibrary(path string, abs string) bool {
+	saved := getsource.SaveSource() // import したファイルを読む間、今のソースの状態を退避
+	savedToken := token
+	fptex, scanner, err := getsource.OpenSource(path)
+	if err != nil {
+		getsource.RestoreSource(saved)
+		return false
+	}
+	defer fptex.Close()
+	savedSyncs := syncs // 回復点は import したファイルのものだけにする
+	syncs = nil
+	imported[abs] = nil // コンパイルの間に同じファイルをまた import してもコンパイルしない
+	importing = append(importing, abs)
+	n0 := getsource.ErrorN()
+	ns := table.BeginNamespace()
+	getsource.InitSource(fptex)
+	token = getsource.NextToken(scanner, fptex)
+	library(scanner, fptex)
+	getsource.FinalSource(fptex)
+	imported[abs] = table.EndNamespace(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), ns)
+	importing = importing[:len(importing)-1]
+	if n := getsource.ErrorN() - n0; n != 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d errors\n", path, n)
+	}
+	getsource.RestoreSource(saved)
+	token = savedToken
+	syncs = savedSyncs
+	return true
+}
+
+// import したファイルのコンパイル、定数宣言と関数宣言を並べて . で終わる
+func library(scanner *bufio.Scanner, fptex *os.File) {
+	for token.Kind != getsource.Period {
+		switch token.Kind {
+		case getsource.Const: // 定数宣言部
+			token = getsource.NextToken(scanner, fptex)
+			constDecl(scanner, fptex)
+		case getsource.Func: // 関数宣言部
+			token = getsource.NextToken(scanner, fptex)
+			funcDecl(getsource.FuncID, scanner, fptex)
+		case getsource.Proc: // 手続き宣言部
+			token = getsource.NextToken(scanner, fptex)
+			funcDecl(getsource.ProcID, scanner, fptex)
+		case getsource.Import: // import 宣言
+			importDecl(scanner, fptex)
+		default: // 宣言の先頭のキーまで読み捨てる
+			skipTo(newSet(getsource.Const, getsource.Func, getsource.Proc, getsource.Import, getsource.Period), scanner, fptex)
+		}
+	}
+	checkFwd(fptex)
+}
+
 // 定数宣言
 func constDecl(scanner *bufio.Scanner, fptex *os.File) {
 	var temp getsource.Token
@@ -69,13 +291,10 @@ func constDecl(scanner *bufio.Scanner, fptex *os.File) {
 		if token.Kind == getsource.Id {
 			getsource.SetIdKind(getsource.ConstID) // 印字のための情報セット
 			temp = token
-			token = getsource.CheckGet(getsource.NextToken(scanner, fptex), getsource.Equal, scanner, fptex) // 名前の次は = のはず
-			if token.Kind == getsource.Num {
-				table.EnterTconst(temp.U.ID, token.U.Value, fptex) // 定数名と値をテーブルに
-			} else {
-				getsource.ErrorType("number", fptex)
-			}
 			token = getsource.NextToken(scanner, fptex)
+			checkGet(getsource.Equal, scanner, fptex)                                  // 名前の次は = のはず
+			ti := table.EnterTconst(temp.U.ID, constExpression(scanner, fptex), fptex) // 定数名と定数式の値をテーブルに
+			table.SetPos(ti, temp.Pos)                                                 // 宣言の位置は名前の位置
 		} else {
 			getsource.ErrorMissingID(fptex)
 		}
@@ -89,16 +308,36 @@ func constDecl(scanner *bufio.Scanner, fptex *os.File) {
 		}
 		token = getsource.NextToken(scanner, fptex)
 	}
-	token = getsource.CheckGet(token, getsource.Semicolon, scanner, fptex) // 最後は ; のはず
+	checkGet(getsource.Semicolon, scanner, fptex) // 最後は ; のはず
 }
 
-// 変数宣言
+// 変数宣言、 : 型名 はその前の型を書いていない変数すべての型になる
+// var x: integer; ok: boolean のように ; で区切って続けてもよい
 func varDecl(scanner *bufio.Scanner, fptex *os.File) {
+	for {
+		varGroup(scanner, fptex)
+		checkGet(getsource.Semicolon, scanner, fptex) // 最後は ; のはず
+		if token.Kind != getsource.Id || !declFollows(scanner, fptex) {
+			return // 次が名前でも、変数宣言でなければ文
+		}
+	}
+}
+
+// ; で区切った変数宣言のひとつのコンパイル
+func varGroup(scanner *bufio.Scanner, fptex *os.File) {
+	var group []int // 型をまだ決めていない変数名のインデックス
 	for {
 		if token.Kind == getsource.Id {
 			getsource.SetIdKind(getsource.VarID) // 印字のための情報セット
-			table.EnterTvar(token.U.ID, fptex)   // 変数名をテーブルに、番地は table が決める
+			temp := token
 			token = getsource.NextToken(scanner, fptex)
+			if token.Kind == getsource.Lbracket { // 配列宣言
+				group = append(group, arrayDecl(temp.U.ID, scanner, fptex))
+			} else {
+				group = append(group, table.EnterTvar(temp.U.ID, fptex)) // 変数名をテーブルに、番地は table が決める
+			}
+			table.SetPos(group[len(group)-1], temp.Pos) // 宣言の位置は名前の位置
+			group = typeDecl(group, scanner, fptex)
 		} else {
 			getsource.ErrorMissingID(fptex)
 		}
@@ -107,33 +346,273 @@ func varDecl(scanner *bufio.Scanner, fptex *os.File) {
 				getsource.ErrorInsert(getsource.Comma, fptex)
 				continue
 			} else {
-				break
+				return
 			}
 		}
 		token = getsource.NextToken(scanner, fptex)
 	}
-	token = getsource.CheckGet(token, getsource.Semicolon, scanner, fptex) // 最後は ; のはず
 }
 
-// 関数宣言のコンパイル
-func funcDecl(scanner *bufio.Scanner, fptex *os.File) {
+// ; の後の名前が変数宣言の続きか、名前の次のトークンを先読みして決める
+// , か : が続けば宣言、 ; か [ が続くときは手続きの呼び出しか配列の要素への代入でなければ宣言
+func declFollows(scanner *bufio.Scanner, fptex *os.File) bool {
+	k, ok := table.LookupKind(token.U.ID)
+	switch getsource.PeekToken(scanner, fptex).Kind {
+	case getsource.Comma, getsource.Colon:
+		return true
+	case getsource.Semicolon:
+		return !ok || k != getsource.ProcID
+	case getsource.Lbracket:
+		return !ok || k != getsource.ArrayID
+	}
+	return false
+}
+
+// 型の指定 : 型名 があれば、 group の名前の型をそれにして空の group を返す
+func typeDecl(group []int, scanner *bufio.Scanner, fptex *os.File) []int {
+	if token.Kind != getsource.Colon {
+		return group
+	}
+	token = getsource.NextToken(scanner, fptex)
+	t := typeName(scanner, fptex)
+	for _, ti := range group {
+		table.SetType(ti, t)
+	}
+	return nil
+}
+
+// 型名のコンパイル
+func typeName(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	var t getsource.TypeT
+	switch token.Kind {
+	case getsource.Integer:
+		t = getsource.IntType
+	case getsource.Boolean:
+		t = getsource.BoolType
+	default:
+		getsource.ErrorType("type", fptex)
+		return getsource.NoType
+	}
+	token = getsource.NextToken(scanner, fptex)
+	return t
+}
+
+// 配列宣言の添字の範囲 [要素数] か [下限 : 上限] のコンパイル、配列名のインデックスを返す
+func arrayDecl(id string, scanner *bufio.Scanner, fptex *os.File) int {
+	low := 0
+	token = getsource.NextToken(scanner, fptex)
+	high := constExpression(scanner, fptex)
+	if token.Kind == getsource.Colon {
+		token = getsource.NextToken(scanner, fptex)
+		low = high
+		high = constExpression(scanner, fptex)
+	} else {
+		high-- // [n] の添字は 0 から n-1 まで
+	}
+	if high < low { // 要素が 1 つもない
+		getsource.ErrorType("size", fptex)
+		high = low
+	}
+	checkGet(getsource.Rbracket, scanner, fptex)         // 最後は ] のはず
+	return table.EnterTarray(id, low, high-low+1, fptex) // 配列名をテーブルに、要素の番地は table が決める
+}
+
+// 定数式のコンパイル、コンパイル時に計算した値を返す
+// 定数式は数と宣言済みの定数名からなり、演算子の優先順位は式と同じ
+func constExpression(scanner *bufio.Scanner, fptex *os.File) int {
+	var v int
+	k := token.Kind
+	if k == getsource.Plus || k == getsource.Minus {
+		token = getsource.NextToken(scanner, fptex)
+		v = constTerm(scanner, fptex)
+		if k == getsource.Minus {
+			v = constArith(getsource.Minus, 0, v, fptex)
+		}
+	} else {
+		v = constTerm(scanner, fptex)
+	}
+	k = token.Kind
+	for k == getsource.Plus || k == getsource.Minus {
+		token = getsource.NextToken(scanner, fptex)
+		v = constArith(k, v, constTerm(scanner, fptex), fptex)
+		k = token.Kind
+	}
+	return v
+}
+
+// 定数式の項のコンパイル
+func constTerm(scanner *bufio.Scanner, fptex *os.File) int {
+	v := constPower(scanner, fptex)
+	k := token.Kind
+	for k == getsource.Mult || k == getsource.Div || k == getsource.IDiv || k == getsource.Mod {
+		token = getsource.NextToken(scanner, fptex)
+		v = constArith(k, v, constPower(scanner, fptex), fptex)
+		k = token.Kind
+	}
+	return v
+}
+
+// 定数式のべき乗のコンパイル
+func constPower(scanner *bufio.Scanner, fptex *os.File) int {
+	v := constFactor(scanner, fptex)
+	if token.Kind == getsource.Power {
+		token = getsource.NextToken(scanner, fptex)
+		v = constArith(getsource.Power, v, constPower(scanner, fptex), fptex)
+	}
+	return v
+}
+
+// 定数式の因子のコンパイル
+func constFactor(scanner *bufio.Scanner, fptex *os.File) int {
+	var tIndex int
+	v := 0
+	switch token.Kind {
+	case getsource.Num:
+		v = token.U.Value
+	case getsource.Id:
+		tIndex = table.SearchT(token.U.ID, getsource.ConstID, fptex)
+		getsource.SetIdKind(table.RetKindT(tIndex))      // 印字のための情報セット
+		if table.RetKindT(tIndex) == getsource.ConstID { // 定数式には定数名しか書けない
+			v = table.RetVal(tIndex)
+		}
+	case getsource.Lparen:
+		token = getsource.NextToken(scanner, fptex)
+		v = constExpression(scanner, fptex)
+		checkGet(getsource.Rparen, scanner, fptex)
+		return v
+	default:
+		getsource.ErrorType("number", fptex)
+		return 0
+	}
+	token = getsource.NextToken(scanner, fptex)
+	return v
+}
+
+// 定数式の演算 a op b 、あふれと 0 除算はエラーにして 0 を返す
+// 演算の結果は実行時の演算命令と同じ
+func constArith(op getsource.KeyID, a int, b int, fptex *os.File) int {
+	switch op {
+	case getsource.Plus:
+		if (b > 0 && a > math.MaxInt-b) || (b < 0 && a < math.MinInt-b) {
+			return constError("overflow", fptex)
+		}
+		return a + b
+	case getsource.Minus:
+		if (b < 0 && a > math.MaxInt+b) || (b > 0 && a < math.MinInt+b) {
+			return constError("overflow", fptex)
+		}
+		return a - b
+	case getsource.Mult:
+		if a != 0 && ((a*b)/a != b || (a == -1 && b == math.MinInt) || (b == -1 && a == math.MinInt)) {
+			return constError("overflow", fptex)
+		}
+		return a * b
+	case getsource.Div, getsource.IDiv, getsource.Mod:
+		if b == 0 {
+			return constError("div by 0", fptex)
+		}
+		if a == math.MinInt && b == -1 {
+			return constError("overflow", fptex)
+		}
+		if op == getsource.Mod {
+			return a % b
+		}
+		return a / b
+	case getsource.Power:
+		if b < 0 { // 指数が負なら 1/a**(-b) を 0 方向に切り捨てた値
+			if a == 0 {
+				return constError("div by 0", fptex)
+			}
+			if a == -1 && b&1 == 0 {
+				return 1
+			}
+			return 1 / a
+		}
+		if a == 0 && b > 0 {
+			return 0
+		}
+		r := 1
+		for ; b > 0; b >>= 1 { // 2 乗をくりかえす、 a は 0 でないので積が 0 ならあふれ (エラーは出力済み)
+			if b&1 == 1 {
+				if r = constArith(getsource.Mult, r, a, fptex); r == 0 {
+					return 0
+				}
+			}
+			if b > 1 {
+				if a = constArith(getsource.Mult, a, a, fptex); a == 0 {
+					return 0
+				}
+			}
+		}
+		return r
+	}
+	return 0
+}
+
+// 定数式のエラーを出力し 0 を返す
+func constError(m string, fptex *os.File) int {
+	getsource.ErrorMessage(m, fptex)
+	return 0
+}
+
+// 関数宣言・手続き宣言のコンパイル、 k は FuncID か ProcID
+func funcDecl(k getsource.KindT, scanner *bufio.Scanner, fptex *os.File) {
+	var fIndex int
+	var fwdRefs []bool             // forward 宣言されていた関数の各パラメタが参照渡しか
+	var fwdTypes []getsource.TypeT // forward 宣言されていた関数の各パラメタの型
+	var group []int                // 型をまだ決めていないパラメタ名のインデックス
+	var ref bool                   // その組のパラメタは参照渡しか (var は型を書くまでの組の全体にかかる)
+	resumed := false               // forward 宣言した関数の本体か
 	if token.Kind == getsource.Id {
-		getsource.SetIdKind(getsource.FuncID) // 印字のための情報セット
-		// 関数名をテーブルに登録
-		// その先頭番地は次のコードの番地 NextCode()
-		fIndex := table.EnterTfunc(token.U.ID, codegen.NextCode(), fptex)
-		token = getsource.CheckGet(getsource.NextToken(scanner, fptex), getsource.Lparen, scanner, fptex)
-		table.BlockBegin(FIRSTADDR, fptex) // パラメタ名のレベルは関数のブロックと同じ
-		for {
-			if token.Kind == getsource.Id { // パラメタ名がある場合
-				getsource.SetIdKind(getsource.ParID) // 印字のための情報セット
-				table.EnterTpar(token.U.ID, fptex)   // パラメタ名をテーブルに登録
+		getsource.SetIdKind(k)                                 // 印字のための情報セット
+		if fIndex = table.SearchFwd(token.U.ID); fIndex != 0 { // forward 宣言した関数の本体
+			if table.RetKindT(fIndex) != k {
+				getsource.ErrorType(table.RetKindT(fIndex).String(), fptex) // 関数と手続きが食い違う
+			}
+			fwdRefs, fwdTypes = table.ResumeTfunc(fIndex)
+			table.ChangeV(fIndex, codegen.NextCode()) // 本体の中から呼ぶときの先頭番地は本体のもの
+			resumed = true
+		} else if k == getsource.ProcID {
+			// 関数名をテーブルに登録
+			// その先頭番地は次のコードの番地 NextCode()
+			fIndex = table.EnterTproc(token.U.ID, codegen.NextCode(), fptex)
+		} else {
+			fIndex = table.EnterTfunc(token.U.ID, codegen.NextCode(), fptex)
+		}
+		token = getsource.NextToken(scanner, fptex)
+		bare := k == getsource.ProcID && token.Kind != getsource.Lparen // パラメタのない手続きは () を省略できる
+		if !bare {
+			checkGet(getsource.Lparen, scanner, fptex)
+		}
+		table.BlockBegin(codegen.FirstAddr(), fptex) // パラメタ名のレベルは関数のブロックと同じ
+		for !bare {
+			if token.Kind == getsource.Var {
+				ref = true
 				token = getsource.NextToken(scanner, fptex)
+			}
+			if token.Kind == getsource.Id { // パラメタ名がある場合
+				id, pos := token.U.ID, token.Pos
+				if ref {
+					getsource.SetIdKind(getsource.RefID) // 印字のための情報セット
+					token = getsource.NextToken(scanner, fptex)
+					group = append(group, table.EnterTref(id, fptex)) // 参照渡しのパラメタ名をテーブルに登録
+				} else {
+					getsource.SetIdKind(getsource.ParID) // 印字のための情報セット
+					token = getsource.NextToken(scanner, fptex)
+					group = append(group, table.EnterTpar(id, fptex)) // パラメタ名をテーブルに登録
+				}
+				table.SetPos(group[len(group)-1], pos) // 宣言の位置は名前の位置
+				if group = typeDecl(group, scanner, fptex); group == nil {
+					ref = false // 型を書いたら組は終わり
+				}
 			} else {
+				if ref {
+					getsource.ErrorMissingID(fptex)
+				}
 				break
 			}
 			if token.Kind != getsource.Comma { // 次がコンマならパラメタ名が続く
-				if token.Kind == getsource.Id { // 次が名前ならコンマを忘れたことに
+				if token.Kind == getsource.Id || token.Kind == getsource.Var { // 次が名前ならコンマを忘れたことに
 					getsource.ErrorInsert(getsource.Comma, fptex)
 					continue
 				} else {
@@ -142,19 +621,61 @@ func funcDecl(scanner *bufio.Scanner, fptex *os.File) {
 			}
 			token = getsource.NextToken(scanner, fptex)
 		}
-		token = getsource.CheckGet(token, getsource.Rparen, scanner, fptex) // 最後は ) のはず
-		table.Endpar()                                                      // パラメタ部が終わったことをテーブルに連絡
+		if !bare {
+			checkGet(getsource.Rparen, scanner, fptex) // 最後は ) のはず
+		}
+		table.Endpar() // パラメタ部が終わったことをテーブルに連絡
+		if resumed && !samePars(fwdRefs, fwdTypes, fIndex) {
+			getsource.ErrorMessage("\\#par", fptex) // forward 宣言とパラメタが違う
+		}
+		if token.Kind == getsource.Colon { // 関数の結果の型
+			if k == getsource.ProcID {
+				getsource.ErrorMessage("proc", fptex) // 手続きは値を返さない
+			}
+			token = getsource.NextToken(scanner, fptex)
+			t := typeName(scanner, fptex)
+			if resumed && t != table.RetType(fIndex) {
+				getsource.ErrorMessage("type", fptex) // forward 宣言と結果の型が違う
+			} else if k == getsource.FuncID {
+				table.SetType(fIndex, t)
+			}
+		}
+		if token.Kind == getsource.Forward && !resumed { // forward 宣言、本体は後で宣言する
+			table.SetFwd(fIndex)
+			fwdCalls[fIndex] = nil
+			token = getsource.NextToken(scanner, fptex)
+			table.BlockEnd()
+			checkGet(getsource.Semicolon, scanner, fptex) // 最後は ; のはず
+			return
+		}
 		if token.Kind == getsource.Semicolon {
 			getsource.ErrorDelete(fptex)
 			token = getsource.NextToken(scanner, fptex)
 		}
-		block(fIndex, scanner, fptex)                                          // ブロックのコンパイル、その関数名のインデックスを渡す
-		token = getsource.CheckGet(token, getsource.Semicolon, scanner, fptex) // 最後は ; のはず
+		block(fIndex, scanner, fptex) // ブロックのコンパイル、その関数名のインデックスを渡す
+		for _, c := range fwdCalls[fIndex] {
+			codegen.ChangeA(c, table.RetRelAddr(fIndex).Addr) // 本体より前の call 命令へのバックパッチ
+		}
+		delete(fwdCalls, fIndex)
+		checkGet(getsource.Semicolon, scanner, fptex) // 最後は ; のはず
 	} else {
 		getsource.ErrorMissingID(fptex) // 関数名がない
 	}
 }
 
+// forward 宣言のパラメタ refs, types と関数 fIndex のパラメタは同じか？
+func samePars(refs []bool, types []getsource.TypeT, fIndex int) bool {
+	if len(refs) != table.RetPars(fIndex) {
+		return false
+	}
+	for i, r := range refs {
+		if table.IsRef(fIndex, i) != r || table.RetParType(fIndex, i) != types[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // 文のコンパイル
 func statement(scanner *bufio.Scanner, fptex *os.File) {
 	var tIndex int
@@ -165,29 +686,87 @@ func statement(scanner *bufio.Scanner, fptex *os.File) {
 		case getsource.Id: // 代入文のコンパイル
 			tIndex = table.SearchT(token.U.ID, getsource.VarID, fptex)
 			k = table.RetKindT(tIndex)
-			getsource.SetIdKind(k)                                // 印字のための情報セット
-			if (k != getsource.VarID) && (k != getsource.ParID) { // 変数名かパラメタ名のはず
-				getsource.ErrorType("var/par", fptex)
+			getsource.SetIdKind(k)     // 印字のための情報セット
+			if k == getsource.ProcID { // call を省略した手続き呼び出し
+				callStatement(tIndex, scanner, fptex)
+				return
+			}
+			if k == getsource.FuncID { // 関数名の後が ( なら call を省略した関数呼び出し
+				pos := token.Pos
+				token = getsource.NextToken(scanner, fptex)
+				if token.Kind == getsource.Lparen {
+					callRest(tIndex, pos, scanner, fptex)
+					return
+				}
+				getsource.ErrorMessage(fmt.Sprintf("%s,\\ not\\ var", k), fptex) // 関数名には代入できない
+				checkGet(getsource.Assign, scanner, fptex)
+				condition(scanner, fptex)
+				return
+			}
+			u := table.MarkWrite(tIndex) // 左辺の名前は書き込み、値の型は式の後で調べる
+			if k == getsource.ArrayID {  // 配列の要素への代入
+				pos := token.Pos
+				token = getsource.NextToken(scanner, fptex)
+				arrayIndex(tIndex, scanner, fptex)                            // 添字のコンパイル
+				checkGet(getsource.Assign, scanner, fptex)                    // := のはず
+				table.SetUseType(tIndex, u, condition(scanner, fptex), fptex) // 式のコンパイル
+				codegen.SetPos(pos)                                           // 添字の範囲のエラーは配列名の位置
+				codegen.GenCodeA(codegen.Stx, tIndex, fptex)                  // 要素への代入命令
+				return
+			}
+			if k == getsource.RefID { // 参照渡しのパラメタの指す変数への代入
+				codegen.GenCodeT(codegen.Lod, tIndex, fptex) // 変数の番地
+				token = getsource.NextToken(scanner, fptex)
+				checkGet(getsource.Assign, scanner, fptex)                    // := のはず
+				table.SetUseType(tIndex, u, condition(scanner, fptex), fptex) // 式のコンパイル
+				codegen.GenCodeV(codegen.Sti, 0, fptex)                       // その番地への代入命令
+				return
 			}
-			token = getsource.CheckGet(getsource.NextToken(scanner, fptex), getsource.Assign, scanner, fptex) // := のはず
-			expression(scanner, fptex)                                                                        // 式のコンパイル
-			codegen.GenCodeT(codegen.Sto, tIndex, fptex)                                                      // 左辺への代入命令
+			varType(tIndex, fptex) // 代入できる名前か
+			token = getsource.NextToken(scanner, fptex)
+			checkGet(getsource.Assign, scanner, fptex)                    // := のはず
+			table.SetUseType(tIndex, u, condition(scanner, fptex), fptex) // 式のコンパイル
+			codegen.GenCodeT(codegen.Sto, tIndex, fptex)                  // 左辺への代入命令
 			return
 		case getsource.If: // if 文のコンパイル
 			token = getsource.NextToken(scanner, fptex)
-			condition(scanner, fptex)                                         // 条件式のコンパイル
-			token = getsource.CheckGet(token, getsource.Then, scanner, fptex) // then のはず
-			backP = codegen.GenCodeV(codegen.Jpc, 0, fptex)                   // jpc 命令
-			statement(scanner, fptex)                                         // 文のコンパイル
-			codegen.BackPatch(backP)                                          // 上の jpc 命令にバックパッチ
+			pushSync(newSet(getsource.Then))
+			checkType(getsource.BoolType, condition(scanner, fptex), fptex) // 条件式のコンパイル
+			popSync()
+			checkGet(getsource.Then, scanner, fptex)        // then のはず
+			backP = codegen.GenCodeV(codegen.Jpc, 0, fptex) // jpc 命令
+			statement(scanner, fptex)                       // 文のコンパイル
+			codegen.BackPatch(backP)                        // 上の jpc 命令にバックパッチ
 			return
 		case getsource.Ret: // return 文のコンパイル
 			token = getsource.NextToken(scanner, fptex)
-			expression(scanner, fptex) // 式のコンパイル
-			codegen.GenCodeR(fptex)    // ret 命令
+			if table.FKind() == getsource.ProcID { // 手続きは値を返さない
+				if followStatement[token.Kind] || inSync(token.Kind) {
+					codegen.GenCodeV(codegen.Lit, 0, fptex) // ret 命令が取り除く値
+				} else {
+					getsource.ErrorMessage("procedure\\ cannot\\ return\\ a\\ value", fptex)
+					condition(scanner, fptex) // 式の値は ret 命令が取り除く
+				}
+			} else {
+				checkType(table.FType(), condition(scanner, fptex), fptex) // 式のコンパイル
+			}
+			codegen.GenCodeR(fptex) // ret 命令
+			return
+		case getsource.Call: // call 文のコンパイル
+			token = getsource.NextToken(scanner, fptex)
+			if token.Kind != getsource.Id {
+				getsource.ErrorMissingID(fptex)
+				return
+			}
+			tIndex = table.SearchT(token.U.ID, getsource.ProcID, fptex)
+			k = table.RetKindT(tIndex)
+			getsource.SetIdKind(k) // 印字のための情報セット
+			callStatement(tIndex, scanner, fptex)
 			return
 		case getsource.Begin:
 			token = getsource.NextToken(scanner, fptex)
+			pushSync(newSet(getsource.Semicolon, getsource.End))
+			defer popSync()
 			for {
 				statement(scanner, fptex) // 文のコンパイル
 				for {
@@ -199,161 +778,513 @@ func statement(scanner *bufio.Scanner, fptex *os.File) {
 						token = getsource.NextToken(scanner, fptex)
 						return
 					}
-					if isStBeginKey(token) == 1 { // 次が文の先頭記号なら
+					if firstStatement[token.Kind] { // 次が文の先頭記号なら
 						getsource.ErrorInsert(getsource.Semicolon, fptex) // ; を忘れたことにする
 						break
 					}
-					getsource.ErrorDelete(fptex) // それ以外ならエラーとして読み捨てる
-					token = getsource.NextToken(scanner, fptex)
+					if inSync(token.Kind) { // 外側の構文の続きなら
+						getsource.ErrorInsert(getsource.End, fptex) // end を忘れたことにする
+						return
+					}
+					skipTo(firstStatement, scanner, fptex) // それ以外ならエラーとして読み捨てる
 				}
 			}
 		case getsource.While: // while 文のコンパイル
 			token = getsource.NextToken(scanner, fptex)
-			backP2 = codegen.NextCode()                                     // while 文の最後の jmp 命令の飛び先
-			condition(scanner, fptex)                                       // 条件式のコンパイル
-			token = getsource.CheckGet(token, getsource.Do, scanner, fptex) // do のはず
-			backP = codegen.GenCodeV(codegen.Jpc, 0, fptex)                 // 条件式が偽の時飛び出す jpc 命令
-			statement(scanner, fptex)                                       // 文のコンパイル
-			codegen.GenCodeV(codegen.Jmp, backP2, fptex)                    // while 文の先頭へのジャンプ命令
-			codegen.BackPatch(backP)                                        // 偽の時飛び出す jpc 命令へのバックパッチ
+			backP2 = codegen.NextCode() // while 文の最後の jmp 命令の飛び先
+			pushSync(newSet(getsource.Do))
+			checkType(getsource.BoolType, condition(scanner, fptex), fptex) // 条件式のコンパイル
+			popSync()
+			checkGet(getsource.Do, scanner, fptex)          // do のはず
+			backP = codegen.GenCodeV(codegen.Jpc, 0, fptex) // 条件式が偽の時飛び出す jpc 命令
+			loops = append(loops, &loop{start: backP2})
+			statement(scanner, fptex)                    // 文のコンパイル
+			codegen.GenCodeV(codegen.Jmp, backP2, fptex) // while 文の先頭へのジャンプ命令
+			codegen.BackPatch(backP)                     // 偽の時飛び出す jpc 命令へのバックパッチ
+			for _, b := range loops[len(loops)-1].breaks {
+				codegen.BackPatch(b) // break の jmp 命令へのバックパッチ
+			}
+			loops = loops[:len(loops)-1]
+			return
+		case getsource.Break: // break 文のコンパイル
+			if len(loops) == 0 {
+				getsource.ErrorType("loop", fptex) // while 文の外
+			} else {
+				l := loops[len(loops)-1]
+				l.breaks = append(l.breaks, codegen.GenCodeV(codegen.Jmp, 0, fptex))
+			}
+			token = getsource.NextToken(scanner, fptex)
+			return
+		case getsource.Continue: // continue 文のコンパイル
+			if len(loops) == 0 {
+				getsource.ErrorType("loop", fptex) // while 文の外
+			} else {
+				codegen.GenCodeV(codegen.Jmp, loops[len(loops)-1].start, fptex)
+			}
+			token = getsource.NextToken(scanner, fptex)
+			return
+		case getsource.Exit: // exit 文のコンパイル、関数では 0 を返す
+			token = getsource.NextToken(scanner, fptex)
+			codegen.GenCodeV(codegen.Lit, 0, fptex)
+			codegen.GenCodeR(fptex)
 			return
 		case getsource.Write: // write 文のコンパイル
+			pos := token.Pos
 			token = getsource.NextToken(scanner, fptex)
-			expression(scanner, fptex)
-			codegen.GenCodeO(codegen.Wrt, fptex) // 改行を出力する wrl 命令
+			condition(scanner, fptex) // 真理値は 1 か 0 を出力
+			codegen.SetPos(pos)
+			codegen.GenCodeO(codegen.Wrt, fptex)
 			return
 		case getsource.WriteLn:
 			token = getsource.NextToken(scanner, fptex)
 			codegen.GenCodeO(codegen.Wrl, fptex)
 			return
+		case getsource.Read, getsource.ReadLn: // read 文のコンパイル
+			readStatement(scanner, fptex)
+			return
+		case getsource.Case: // case 文のコンパイル
+			caseStatement(scanner, fptex)
+			return
 		case getsource.End: // 空文を読んだことにして終わり
 			return
 		case getsource.Semicolon: // 空文を読んだことにして終わり
 			return
-		default: // 文の先頭のキーまで読み捨てる
-			getsource.ErrorDelete(fptex) // 今読んだトークンを読み捨てる
-			token = getsource.NextToken(scanner, fptex)
+		default: // 文の先頭か文の後に来るキーまで読み捨てる
+			if followStatement[token.Kind] || inSync(token.Kind) { // 空文を読んだことにして終わり
+				return
+			}
+			skipTo(firstStatement.union(followStatement), scanner, fptex)
 			continue
 		}
 	}
 }
 
-// トークン t は文の先頭のキーか？
-func isStBeginKey(t getsource.Token) int {
+// case 文のコンパイル
+// 各選択肢の文の後に選択のためのコードを置き、ラベルが密なら飛び先表、疎なら比較の列にする
+// 選択肢の文の先頭には選択子の値がスタックに残ったまま飛んでくる
+func caseStatement(scanner *bufio.Scanner, fptex *os.File) {
+	var labels []int             // ラベルの値 (出現順)
+	targets := make(map[int]int) // ラベルの値から選択肢の文の先頭番地へ
+	var exits []int              // case 文の最後へ飛ぶ jmp 命令 (バックパッチ用)
+	var v, body int
+	token = getsource.NextToken(scanner, fptex)
+	pushSync(newSet(getsource.Of))
+	checkType(getsource.IntType, condition(scanner, fptex), fptex) // 選択子のコンパイル
+	popSync()
+	checkGet(getsource.Of, scanner, fptex)           // of のはず
+	backP := codegen.GenCodeV(codegen.Jmp, 0, fptex) // 選択のコードへ飛ぶ、後でバックパッチ
+	pushSync(newSet(getsource.Colon, getsource.Semicolon, getsource.Else, getsource.End))
+	for isLabelBegin(token) {
+		body = codegen.NextCode()
+		for {
+			v = constExpression(scanner, fptex)
+			if _, ok := targets[v]; ok {
+				getsource.ErrorMessage("dup", fptex) // 同じラベルが既にある
+			} else {
+				labels = append(labels, v)
+				targets[v] = body
+			}
+			if token.Kind != getsource.Comma { // 次がコンマならラベルが続く
+				break
+			}
+			token = getsource.NextToken(scanner, fptex)
+		}
+		checkGet(getsource.Colon, scanner, fptex) // : のはず
+		codegen.GenCodeV(codegen.Ict, -1, fptex)  // 選択子の値を捨てる
+		statement(scanner, fptex)
+		exits = append(exits, codegen.GenCodeV(codegen.Jmp, 0, fptex))
+		if token.Kind == getsource.Semicolon {
+			token = getsource.NextToken(scanner, fptex)
+		}
+	}
+	others := codegen.NextCode() // どのラベルにも一致しない時の飛び先
+	codegen.GenCodeV(codegen.Ict, -1, fptex)
+	if token.Kind == getsource.Else {
+		token = getsource.NextToken(scanner, fptex)
+		statement(scanner, fptex)
+		if token.Kind == getsource.Semicolon {
+			token = getsource.NextToken(scanner, fptex)
+		}
+	}
+	exits = append(exits, codegen.GenCodeV(codegen.Jmp, 0, fptex))
+	popSync()
+	checkGet(getsource.End, scanner, fptex) // end のはず
+	codegen.BackPatch(backP)
+	if low, high, dense := denseLabels(labels); dense { // 飛び先表
+		if low != 0 {
+			codegen.GenCodeV(codegen.Lit, low, fptex)
+			codegen.GenCodeO(codegen.Sub, fptex)
+		}
+		codegen.GenCodeV(codegen.Jix, high-low+1, fptex)
+		for i := 0; i <= high-low; i++ { // high が最大の整数でも終わるように
+			if t, ok := targets[low+i]; ok {
+				codegen.GenCodeV(codegen.Jmp, t, fptex)
+			} else {
+				codegen.GenCodeV(codegen.Jmp, others, fptex)
+			}
+		}
+	} else { // 比較の列
+		for _, v = range labels {
+			codegen.GenCodeO(codegen.Dup, fptex)
+			codegen.GenCodeV(codegen.Lit, v, fptex)
+			codegen.GenCodeO(codegen.Neq, fptex)
+			codegen.GenCodeV(codegen.Jpc, targets[v], fptex) // 等しければ選択肢へ
+		}
+	}
+	codegen.GenCodeV(codegen.Jmp, others, fptex)
+	for _, e := range exits {
+		codegen.BackPatch(e)
+	}
+}
+
+// ラベルが飛び先表にするほど密か？その時はラベルの最小値と最大値も返す
+func denseLabels(labels []int) (int, int, bool) {
+	if len(labels) < 3 { // 少なければ比較の方が短い
+		return 0, 0, false
+	}
+	low, high := labels[0], labels[0]
+	for _, v := range labels {
+		if v < low {
+			low = v
+		}
+		if v > high {
+			high = v
+		}
+	}
+	if span := high - low; span < 0 || span >= MAXJUMP { // 幅が表に入らない (負なら桁あふれ)
+		return 0, 0, false
+	}
+	if high-low+1 > 2*len(labels) { // 表の半分以上が空き
+		return 0, 0, false
+	}
+	return low, high, true
+}
+
+// トークン t は case のラベルの先頭か？
+func isLabelBegin(t getsource.Token) bool {
 	switch t.Kind {
-	case getsource.If:
-		fallthrough
-	case getsource.Begin:
-		fallthrough
-	case getsource.Ret:
-		fallthrough
-	case getsource.While:
-		fallthrough
-	case getsource.Write:
-		fallthrough
-	case getsource.WriteLn:
-		return 1
+	case getsource.Num, getsource.Id, getsource.Plus, getsource.Minus, getsource.Lparen:
+		return true
 	default:
-		return 0
+		return false
 	}
 }
 
-// 式のコンパイル
-func expression(scanner *bufio.Scanner, fptex *os.File) {
-	k := token.Kind
+// read 文のコンパイル、 readln は読んだ後に行の残りを読み捨てる
+func readStatement(scanner *bufio.Scanner, fptex *os.File) {
+	var tIndex int
+	var k getsource.KindT
+	ln := token.Kind == getsource.ReadLn
+	token = getsource.NextToken(scanner, fptex)
+	if ln && token.Kind != getsource.Id { // 名前のない readln は行を読み捨てるだけ
+		codegen.GenCodeO(codegen.Rdl, fptex)
+		return
+	}
+	for {
+		if token.Kind == getsource.Id {
+			tIndex = table.SearchT(token.U.ID, getsource.VarID, fptex)
+			k = table.RetKindT(tIndex)
+			getsource.SetIdKind(k)                                                      // 印字のための情報セット
+			table.SetUseType(tIndex, table.MarkWrite(tIndex), getsource.IntType, fptex) // 読んだ整数を書き込む
+			if k == getsource.ArrayID {
+				pos := token.Pos
+				token = getsource.NextToken(scanner, fptex)
+				arrayIndex(tIndex, scanner, fptex)
+				codegen.SetPos(pos)
+				codegen.GenCodeO(codegen.Red, fptex) // 整数を 1 つ読む
+				codegen.SetPos(pos)
+				codegen.GenCodeA(codegen.Stx, tIndex, fptex) // 読んだ値を要素へ
+			} else if k == getsource.RefID {
+				token = getsource.NextToken(scanner, fptex)
+				codegen.GenCodeT(codegen.Lod, tIndex, fptex) // 変数の番地
+				codegen.GenCodeO(codegen.Red, fptex)         // 整数を 1 つ読む
+				codegen.GenCodeV(codegen.Sti, 0, fptex)      // 読んだ値をその番地へ
+			} else {
+				varType(tIndex, fptex)
+				token = getsource.NextToken(scanner, fptex)
+				codegen.GenCodeO(codegen.Red, fptex)         // 整数を 1 つ読む
+				codegen.GenCodeT(codegen.Sto, tIndex, fptex) // 読んだ値を変数へ
+			}
+		} else {
+			getsource.ErrorMissingID(fptex)
+		}
+		if token.Kind != getsource.Comma { // 次がコンマなら名前が続く
+			break
+		}
+		token = getsource.NextToken(scanner, fptex)
+	}
+	if ln {
+		codegen.GenCodeO(codegen.Rdl, fptex)
+	}
+}
+
+// 配列の添字 [式] のコンパイル、添字は下限を 0 とする値にしておく
+func arrayIndex(tIndex int, scanner *bufio.Scanner, fptex *os.File) {
+	if token.Kind == getsource.Lbracket {
+		token = getsource.NextToken(scanner, fptex)
+		pushSync(newSet(getsource.Rbracket))
+		checkType(getsource.IntType, condition(scanner, fptex), fptex)
+		popSync()
+		checkGet(getsource.Rbracket, scanner, fptex) // 最後は ] のはず
+	} else {
+		getsource.ErrorInsert(getsource.Lbracket, fptex)
+		getsource.ErrorInsert(getsource.Rbracket, fptex)
+		codegen.GenCodeV(codegen.Lit, table.RetLow(tIndex), fptex)
+	}
+	if low := table.RetLow(tIndex); low != 0 {
+		codegen.GenCodeV(codegen.Lit, low, fptex)
+		codegen.GenCodeO(codegen.Sub, fptex)
+	}
+}
+
+// 手続き呼び出し文のコンパイル、 token は手続き名
+func callStatement(tIndex int, scanner *bufio.Scanner, fptex *os.File) {
+	pos := token.Pos
+	token = getsource.NextToken(scanner, fptex)
+	callRest(tIndex, pos, scanner, fptex)
+}
+
+// 手続き呼び出し文の名前の後のコンパイル、 token は名前の次のトークン、 pos は名前の位置
+func callRest(tIndex int, pos getsource.Pos, scanner *bufio.Scanner, fptex *os.File) {
+	if table.RetKindT(tIndex) == getsource.FuncID {
+		getsource.WarningMessage("value\\ dropped", fptex) // 関数の値を捨てる
+	}
+	if token.Kind == getsource.Lparen {
+		callArgs(tIndex, scanner, fptex)
+	} else if table.RetPars(tIndex) != 0 { // 引数のない手続きは () を省略できる
+		getsource.ErrorMessage("\\#par", fptex)
+	}
+	genCall(tIndex, pos, fptex)              // call 命令
+	codegen.GenCodeV(codegen.Ict, -1, fptex) // ret 命令が残した値を捨てる
+}
+
+// 関数名の位置 pos での call 命令の生成、本体がまだない関数なら後でバックパッチする
+func genCall(tIndex int, pos getsource.Pos, fptex *os.File) {
+	codegen.SetPos(pos)
+	c := codegen.GenCodeT(codegen.Cal, tIndex, fptex)
+	if table.IsFwd(tIndex) {
+		fwdCalls[tIndex] = append(fwdCalls[tIndex], c)
+	}
+}
+
+// 実引数並びのコンパイル、 token は (
+func callArgs(tIndex int, scanner *bufio.Scanner, fptex *os.File) {
+	i := 0 // i は実引数の個数
+	token = getsource.NextToken(scanner, fptex)
+	if token.Kind != getsource.Rparen {
+		pushSync(newSet(getsource.Comma, getsource.Rparen))
+		defer popSync()
+		for {
+			if table.IsRef(tIndex, i) {
+				refArg(table.RetParType(tIndex, i), scanner, fptex) // 参照渡しの実引数は変数の番地
+			} else {
+				checkType(table.RetParType(tIndex, i), condition(scanner, fptex), fptex)
+			}
+			i++ // 実引数のコンパイル
+			if token.Kind == getsource.Comma {
+				token = getsource.NextToken(scanner, fptex)
+				continue
+			}
+			checkGet(getsource.Rparen, scanner, fptex)
+			break
+		}
+	} else {
+		token = getsource.NextToken(scanner, fptex)
+	}
+	if table.RetPars(tIndex) != i { // RetPars(tIndex) は仮引数の個数
+		getsource.ErrorMessage("\\#par", fptex)
+	}
+}
+
+// 参照渡しの実引数のコンパイル、変数の番地を積む、 want はパラメタの型
+func refArg(want getsource.TypeT, scanner *bufio.Scanner, fptex *os.File) {
+	if token.Kind != getsource.Id {
+		getsource.ErrorType("var", fptex) // 変数でないものは参照渡しできない
+		condition(scanner, fptex)
+		return
+	}
+	tIndex := table.SearchT(token.U.ID, getsource.VarID, fptex)
+	k := table.RetKindT(tIndex)
+	getsource.SetIdKind(k) // 印字のための情報セット
+	switch k {
+	case getsource.VarID, getsource.ParID, getsource.RefID, getsource.ArrayID:
+		table.SetUseType(tIndex, table.MarkWrite(tIndex), want, fptex) // 参照渡しの先で want の型の値が書き込まれうる
+	}
+	switch k {
+	case getsource.VarID, getsource.ParID:
+		codegen.GenCodeT(codegen.Lda, tIndex, fptex)
+		token = getsource.NextToken(scanner, fptex)
+	case getsource.RefID: // 参照渡しのパラメタはその番地をそのまま渡す
+		codegen.GenCodeT(codegen.Lod, tIndex, fptex)
+		token = getsource.NextToken(scanner, fptex)
+	case getsource.ArrayID: // 配列の要素
+		pos := token.Pos
+		token = getsource.NextToken(scanner, fptex)
+		arrayIndex(tIndex, scanner, fptex)
+		codegen.SetPos(pos)
+		codegen.GenCodeA(codegen.Lax, tIndex, fptex)
+	default:
+		getsource.ErrorType("var", fptex)
+		condition(scanner, fptex)
+		return
+	}
+	if token.Kind != getsource.Comma && token.Kind != getsource.Rparen { // 変数の後に演算子が続いた
+		getsource.ErrorType("var", fptex)
+	}
+}
+
+// 式のコンパイル、式の型を返す
+func expression(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	var t getsource.TypeT
+	k, pos := token.Kind, token.Pos
 	if k == getsource.Plus || k == getsource.Minus {
 		token = getsource.NextToken(scanner, fptex)
-		term(scanner, fptex)
+		checkType(getsource.IntType, term(scanner, fptex), fptex)
 		if k == getsource.Minus {
+			codegen.SetPos(pos)
 			codegen.GenCodeO(codegen.Neg, fptex)
 		}
+		t = getsource.IntType
 	} else {
-		term(scanner, fptex)
+		t = term(scanner, fptex)
 	}
-	k = token.Kind
+	k, pos = token.Kind, token.Pos
 	for k == getsource.Plus || k == getsource.Minus {
+		checkType(getsource.IntType, t, fptex)
 		token = getsource.NextToken(scanner, fptex)
-		term(scanner, fptex)
+		checkType(getsource.IntType, term(scanner, fptex), fptex)
+		codegen.SetPos(pos) // 演算子の位置
 		if k == getsource.Minus {
 			codegen.GenCodeO(codegen.Sub, fptex)
 		} else {
 			codegen.GenCodeO(codegen.Add, fptex)
 		}
-		k = token.Kind
+		t = getsource.IntType
+		k, pos = token.Kind, token.Pos
 	}
+	return t
 }
 
-// 式の項のコンパイル
-func term(scanner *bufio.Scanner, fptex *os.File) {
-	factor(scanner, fptex)
-	k := token.Kind
-	for k == getsource.Mult || k == getsource.Div {
+// 式の項のコンパイル、項の型を返す
+func term(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	t := powerTerm(scanner, fptex)
+	k, pos := token.Kind, token.Pos
+	for k == getsource.Mult || k == getsource.Div || k == getsource.IDiv || k == getsource.Mod {
+		checkType(getsource.IntType, t, fptex)
 		token = getsource.NextToken(scanner, fptex)
-		factor(scanner, fptex)
-		if k == getsource.Mult {
+		checkType(getsource.IntType, powerTerm(scanner, fptex), fptex)
+		codegen.SetPos(pos) // 0 で割ったエラーは演算子の位置
+		switch k {
+		case getsource.Mult:
 			codegen.GenCodeO(codegen.Mul, fptex)
-		} else {
+		case getsource.Div, getsource.IDiv: // div は / と同じ
 			codegen.GenCodeO(codegen.Div, fptex)
+		case getsource.Mod:
+			codegen.GenCodeO(codegen.Mod, fptex)
 		}
-		k = token.Kind
+		t = getsource.IntType
+		k, pos = token.Kind, token.Pos
 	}
+	return t
 }
 
-// 式の因子のコンパイル
-func factor(scanner *bufio.Scanner, fptex *os.File) {
-	var tIndex, i int
+// べき乗のコンパイル、 ** は右結合で * や / より強く結びつく
+func powerTerm(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	t := factor(scanner, fptex)
+	if token.Kind == getsource.Power {
+		pos := token.Pos
+		checkType(getsource.IntType, t, fptex)
+		token = getsource.NextToken(scanner, fptex)
+		checkType(getsource.IntType, powerTerm(scanner, fptex), fptex)
+		codegen.SetPos(pos)
+		codegen.GenCodeO(codegen.Pow, fptex)
+		return getsource.IntType
+	}
+	return t
+}
+
+// 式の因子のコンパイル、因子の型を返す
+func factor(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	var tIndex int
 	var k getsource.KindT
+	t := getsource.NoType
+	var name string // 関数でない名前
 	if token.Kind == getsource.Id {
 		tIndex = table.SearchT(token.U.ID, getsource.VarID, fptex)
 		k = table.RetKindT(tIndex)
 		getsource.SetIdKind(table.RetKindT(tIndex)) // 印字のための情報セット
+		t = table.RetType(tIndex)
 		switch k {
 		case getsource.VarID:
 			fallthrough
 		case getsource.ParID: // 変数名かパラメタ名
 			codegen.GenCodeT(codegen.Lod, tIndex, fptex)
+			name = token.U.ID
+			token = getsource.NextToken(scanner, fptex)
+			break
+		case getsource.RefID: // 参照渡しのパラメタ名
+			codegen.GenCodeT(codegen.Lod, tIndex, fptex)
+			codegen.GenCodeV(codegen.Ldi, 0, fptex)
+			name = token.U.ID
 			token = getsource.NextToken(scanner, fptex)
 			break
 		case getsource.ConstID: // 定数名
 			codegen.GenCodeV(codegen.Lit, table.RetVal(tIndex), fptex)
+			name = token.U.ID
 			token = getsource.NextToken(scanner, fptex)
 			break
+		case getsource.ArrayID: // 配列の要素
+			pos := token.Pos
+			token = getsource.NextToken(scanner, fptex)
+			arrayIndex(tIndex, scanner, fptex)
+			codegen.SetPos(pos)
+			codegen.GenCodeA(codegen.Ldx, tIndex, fptex)
+			break
+		case getsource.ProcID: // 手続きは値を返さない
+			getsource.ErrorType("func", fptex)
+			fallthrough
 		case getsource.FuncID: // 関数呼び出し
+			pos := token.Pos
 			token = getsource.NextToken(scanner, fptex)
 			if token.Kind == getsource.Lparen {
-				i = 0 // i は実引数の個数
-				token = getsource.NextToken(scanner, fptex)
-				if token.Kind != getsource.Rparen {
-					for {
-						expression(scanner, fptex)
-						i++ // 実引数のコンパイル
-						if token.Kind == getsource.Comma {
-							token = getsource.NextToken(scanner, fptex)
-							continue
-						}
-						token = getsource.CheckGet(token, getsource.Rparen, scanner, fptex)
-						break
-					}
-				} else {
-					token = getsource.NextToken(scanner, fptex)
-				}
-				if table.RetPars(tIndex) != i { // RetPars(tIndex) は仮引数の個数
-					getsource.ErrorMessage("\\#par", fptex)
-				}
+				callArgs(tIndex, scanner, fptex)
 			} else {
 				getsource.ErrorInsert(getsource.Lparen, fptex)
 				getsource.ErrorInsert(getsource.Rparen, fptex)
 			}
-			codegen.GenCodeT(codegen.Cal, tIndex, fptex) // call 命令
+			genCall(tIndex, pos, fptex) // call 命令
 			break
 		}
 	} else if token.Kind == getsource.Num { // 定数
 		codegen.GenCodeV(codegen.Lit, token.U.Value, fptex)
+		t = getsource.IntType
 		token = getsource.NextToken(scanner, fptex)
-	} else if token.Kind == getsource.Lparen { // (, 因子, )
+	} else if token.Kind == getsource.True || token.Kind == getsource.False { // 真理値の定数、真は 1 で偽は 0
+		v := 0
+		if token.Kind == getsource.True {
+			v = 1
+		}
+		codegen.GenCodeV(codegen.Lit, v, fptex)
+		t = getsource.BoolType
+		token = getsource.NextToken(scanner, fptex)
+	} else if token.Kind == getsource.Lparen { // (, 条件式か式, )
 		token = getsource.NextToken(scanner, fptex)
-		expression(scanner, fptex)
-		token = getsource.CheckGet(token, getsource.Rparen, scanner, fptex)
+		pushSync(newSet(getsource.Rparen))
+		t = condition(scanner, fptex)
+		popSync()
+		checkGet(getsource.Rparen, scanner, fptex)
+	} else if followFactor[token.Kind] || inSync(token.Kind) { // 因子がない
+		getsource.ErrorMissingID(fptex)
+		return getsource.NoType
+	} else { // 因子の先頭まで読み捨てる
+		skipTo(firstFactor.union(followFactor), scanner, fptex)
+		if firstFactor[token.Kind] {
+			return factor(scanner, fptex)
+		}
+		return getsource.NoType
+	}
+	if inSync(token.Kind) || token.Kind == getsource.Id && getsource.PeekToken(scanner, fptex).Kind == getsource.Assign {
+		return t // 因子の後が回復点か代入文なら、式はここで終わり、その前の ; などを忘れた
 	}
 	switch token.Kind { // 因子の後がまた因子ならエラー
 	case getsource.Id:
@@ -361,53 +1292,139 @@ func factor(scanner *bufio.Scanner, fptex *os.File) {
 	case getsource.Num:
 		fallthrough
 	case getsource.Lparen:
-		getsource.ErrorMissingOp(fptex)
+		if token.Kind == getsource.Lparen && name != "" { // 関数でない名前を呼び出そうとした
+			getsource.ErrorMessage(fmt.Sprintf("%s\\ %s,\\ not\\ func", k, name), fptex)
+		} else {
+			getsource.ErrorMissingOp(fptex)
+		}
 		factor(scanner, fptex)
+		return getsource.NoType
 	default:
-		return
+		return t
 	}
 }
 
-// 条件式のコンパイル
-func condition(scanner *bufio.Scanner, fptex *os.File) {
+// 条件式のコンパイル (or で結ばれた条件)、値の型を返す
+// 論理演算子や関係演算子を含まない条件は式で、その型は式の型
+func condition(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	var backP, backP2 int // バックパッチ用
+	t := andCondition(scanner, fptex)
+	for token.Kind == getsource.Or {
+		checkType(getsource.BoolType, t, fptex)
+		token = getsource.NextToken(scanner, fptex)
+		backP = codegen.GenCodeV(codegen.Jpc, 0, fptex)  // 左辺が偽なら右辺を評価する
+		codegen.GenCodeV(codegen.Lit, 1, fptex)          // 左辺が真なら結果は真
+		backP2 = codegen.GenCodeV(codegen.Jmp, 0, fptex) // 右辺を飛び越す
+		codegen.BackPatch(backP)
+		checkType(getsource.BoolType, andCondition(scanner, fptex), fptex)
+		codegen.BackPatch(backP2)
+		t = getsource.BoolType
+	}
+	return t
+}
+
+// and で結ばれた条件のコンパイル
+func andCondition(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	var backP, backP2 int // バックパッチ用
+	t := notCondition(scanner, fptex)
+	for token.Kind == getsource.And {
+		checkType(getsource.BoolType, t, fptex)
+		token = getsource.NextToken(scanner, fptex)
+		backP = codegen.GenCodeV(codegen.Jpc, 0, fptex) // 左辺が偽なら右辺を評価しない
+		checkType(getsource.BoolType, notCondition(scanner, fptex), fptex)
+		backP2 = codegen.GenCodeV(codegen.Jmp, 0, fptex) // 右辺の値が結果
+		codegen.BackPatch(backP)
+		codegen.GenCodeV(codegen.Lit, 0, fptex) // 左辺が偽なら結果は偽
+		codegen.BackPatch(backP2)
+		t = getsource.BoolType
+	}
+	return t
+}
+
+// not の付いた条件のコンパイル
+func notCondition(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
+	if token.Kind == getsource.Not {
+		pos := token.Pos
+		token = getsource.NextToken(scanner, fptex)
+		checkType(getsource.BoolType, notCondition(scanner, fptex), fptex)
+		codegen.SetPos(pos)
+		codegen.GenCodeV(codegen.Lit, 0, fptex)
+		codegen.SetPos(pos)
+		codegen.GenCodeO(codegen.Eq, fptex) // 0 と等しければ真
+		return getsource.BoolType
+	}
+	return relation(scanner, fptex)
+}
+
+// 関係式のコンパイル、 = と <> は同じ型どうし、大小の比較は整数どうし
+func relation(scanner *bufio.Scanner, fptex *os.File) getsource.TypeT {
 	var k getsource.KeyID
 	if token.Kind == getsource.Odd {
+		pos := token.Pos
 		token = getsource.NextToken(scanner, fptex)
-		expression(scanner, fptex)
+		checkType(getsource.IntType, expression(scanner, fptex), fptex)
+		codegen.SetPos(pos)
 		codegen.GenCodeO(codegen.Odd, fptex)
-	} else {
-		expression(scanner, fptex)
-		k = token.Kind
-		switch k {
-		case getsource.Equal:
-			fallthrough
-		case getsource.Gtr:
-			fallthrough
-		case getsource.NotEq:
-			fallthrough
-		case getsource.LssEq:
-			fallthrough
-		case getsource.GtrEq:
-			break
-		default:
-			getsource.ErrorType("rel-op", fptex)
-			break
-		}
-		token = getsource.NextToken(scanner, fptex)
-		expression(scanner, fptex)
-		switch k {
-		case getsource.Equal:
-			codegen.GenCodeO(codegen.Eq, fptex)
-		case getsource.Lss:
-			codegen.GenCodeO(codegen.Ls, fptex)
-		case getsource.Gtr:
-			codegen.GenCodeO(codegen.Gr, fptex)
-		case getsource.NotEq:
-			codegen.GenCodeO(codegen.Neq, fptex)
-		case getsource.LssEq:
-			codegen.GenCodeO(codegen.Lseq, fptex)
-		case getsource.GtrEq:
-			codegen.GenCodeO(codegen.Greq, fptex)
-		}
+		return getsource.BoolType
+	}
+	t := expression(scanner, fptex)
+	k, pos := token.Kind, token.Pos
+	switch k {
+	case getsource.Equal:
+		fallthrough
+	case getsource.NotEq:
+		break
+	case getsource.Lss:
+		fallthrough
+	case getsource.Gtr:
+		fallthrough
+	case getsource.LssEq:
+		fallthrough
+	case getsource.GtrEq:
+		checkType(getsource.IntType, t, fptex)
+		t = getsource.IntType
+	default:
+		return t // 関係演算子がなければ式のまま
+	}
+	token = getsource.NextToken(scanner, fptex)
+	checkType(t, expression(scanner, fptex), fptex)
+	codegen.SetPos(pos) // 関係演算子の位置
+	switch k {
+	case getsource.Equal:
+		codegen.GenCodeO(codegen.Eq, fptex)
+	case getsource.Lss:
+		codegen.GenCodeO(codegen.Ls, fptex)
+	case getsource.Gtr:
+		codegen.GenCodeO(codegen.Gr, fptex)
+	case getsource.NotEq:
+		codegen.GenCodeO(codegen.Neq, fptex)
+	case getsource.LssEq:
+		codegen.GenCodeO(codegen.Lseq, fptex)
+	case getsource.GtrEq:
+		codegen.GenCodeO(codegen.Greq, fptex)
+	}
+	return getsource.BoolType
+}
+
+// 型 got の値は型 want を求めるところに書けるか？ NoType はエラーの後なのでどちらでもよい
+func typeMatch(want getsource.TypeT, got getsource.TypeT) bool {
+	return want == got || want == getsource.NoType || got == getsource.NoType
+}
+
+// 型 got の値が型 want を求めるところに書けなければ型のエラー
+func checkType(want getsource.TypeT, got getsource.TypeT, fptex *os.File) {
+	if !typeMatch(want, got) {
+		getsource.ErrorMessage(fmt.Sprintf("%s,\\ not\\ %s", got, want), fptex)
+	}
+}
+
+// 代入できる名前 (変数名かパラメタ名) なら名前表 [tIndex] の型を返す
+// それ以外の名前は種類のエラーにして NoType を返す
+func varType(tIndex int, fptex *os.File) getsource.TypeT {
+	k := table.RetKindT(tIndex)
+	if k != getsource.VarID && k != getsource.ParID {
+		getsource.ErrorType(fmt.Sprintf("%s,\\ not\\ var", k), fptex)
+		return getsource.NoType
 	}
+	return table.RetType(tIndex)
 }
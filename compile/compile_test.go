@@ -0,0 +1,492 @@
+package compile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/is-hoku/pl0dash-go/codegen"
+	"github.com/is-hoku/pl0dash-go/getsource"
+	"github.com/is-hoku/pl0dash-go/table"
+)
+
+// dir に name というファイル名で置いた src をコンパイルする
+func compileSource(t *testing.T, dir string, name string, src string) (*codegen.Program, error) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fptex, scanner, err := getsource.OpenSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fptex.Close()
+	return Compile(fptex, scanner)
+}
+
+// src をコンパイルして input を入力に実行した出力を返す
+func runSource(t *testing.T, src string, input string) string {
+	t.Helper()
+	prog, err := compileSource(t, t.TempDir(), "prog.pl0", src)
+	if err != nil {
+		t.Fatalf("compile: %s", err)
+	}
+	var out bytes.Buffer
+	if err := codegen.NewVM(&out, strings.NewReader(input), nil).Run(prog); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	return out.String()
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		input string
+		want  string
+	}{
+		{
+			name: "forward",
+			src: `function isodd(n) forward;
+function iseven(n)
+begin
+  if n = 0 then return 1;
+  return isodd(n - 1)
+end;
+function isodd(n)
+begin
+  if n = 0 then return 0;
+  return iseven(n - 1)
+end;
+begin
+  write iseven(10); write isodd(7); write isodd(10)
+end.
+`,
+			want: "1 1 0 ",
+		},
+		{
+			// forward 宣言した関数の本体の中の関数から、その関数を呼ぶ
+			name: "forward nested call",
+			src: `function isodd(n) forward;
+function iseven(n)
+begin
+  if n = 0 then return 1;
+  return isodd(n - 1)
+end;
+function isodd(n)
+  function helper(k)
+  begin return isodd(k) end;
+begin
+  if n = 0 then return 0;
+  if n = 100 then return helper(1);
+  return iseven(n - 1)
+end;
+begin
+  write iseven(10); write iseven(7); write isodd(7); write isodd(100)
+end.
+`,
+			want: "1 0 1 1 ",
+		},
+		{
+			name: "var groups",
+			src: `var x: integer; ok: boolean; a[1:3], n: integer;
+begin
+  x := 2; ok := x = 2; a[3] := x; n := a[3] + 1;
+  if ok then write n
+end.
+`,
+			want: "3 ",
+		},
+		{
+			name: "procedures",
+			src: `var x;
+function f(n) begin x := n; return n end;
+procedure q begin write x end;
+procedure p(a) begin x := a end;
+begin call f(3); q; f(4); call q; p(5); call q() end.
+`,
+			want: "3 4 5 ",
+		},
+		{
+			// and と or は右の条件を必要なときだけ計算する
+			name: "short circuit",
+			src: `function t(n): boolean begin write n; return true end;
+begin
+  if false and t(1) then write 9;
+  if true or t(2) then write 8;
+  if not (false or t(3)) then write 7;
+  write t(4) and not false
+end.
+`,
+			want: "8 3 4 1 ",
+		},
+		{
+			// div は 0 の方向に切り捨て、 mod の符号は被除数と同じ
+			name: "mod div power",
+			src: `var x;
+begin
+  x := -7;
+  write x mod 3; write 7 mod (-3); write x div 2; write 7 / (-2);
+  write 2 ** 10; write (-2) ** 3; write (-1) ** (-2); write 2 ** (-1); write 0 ** 0; write -2 ** 2
+end.
+`,
+			want: "-1 1 -3 -3 1024 -8 1 0 1 -4 ",
+		},
+		{
+			name: "break continue exit",
+			src: `var i;
+begin
+  i := 0;
+  while i < 10 do begin
+    i := i + 1;
+    if i = 3 then continue;
+    if i = 6 then break;
+    write i
+  end;
+  write i;
+  exit;
+  write 0
+end.
+`,
+			want: "1 2 4 5 6 ",
+		},
+		{
+			// if の中の exit や return の後には、その次の関数へ落ちないように ret が要る
+			name: "exit at the end",
+			src: `var x;
+procedure p(a) begin x := a; if a > 100 then exit end;
+procedure q() begin write 7 end;
+function f(n) begin if n = 0 then return 1 end;
+function g(n) begin write 8; return 2 end;
+begin p(3); write x; write f(0) end.
+`,
+			want: "3 1 ",
+		},
+		{
+			name: "const expressions",
+			src: `const a = -5, b = 2 ** 10 - a * 3, c = (a + 1) mod 3, z = 0 ** (4 * 10 ** 18);
+const o = (-1) ** (4 * 10 ** 18 + 1), m = 3 ** 39, h = 2 ** (-1), one = 7 ** 0;
+begin write a; write b; write c; write z; write o; write m; write h; write one end.
+`,
+			want: "-5 1039 -1 0 -1 4052555153018976267 0 1 ",
+		},
+		{
+			name: "var parameter groups",
+			src: `var u, v, w;
+procedure swap(var a, b) var t; begin t := a; a := b; b := t end;
+procedure mix(var a: integer, b, c) begin a := b + c; c := 0 end;
+begin u := 1; v := 2; swap(u, v); write u; write v; w := 5; mix(u, v, w); write u; write w end.
+`,
+			want: "2 1 6 5 ",
+		},
+		{
+			name: "declaration or statement",
+			src: `var a[3], n;
+var y;
+    m;
+procedure p begin n := n + 1 end;
+procedure q() var y; p;
+procedure r() var y; a[1] := 7;
+procedure s() var y;
+  z, w: integer; v[2];
+  u;
+begin z := 1; w := 2; v[0] := 3; u := 4; n := n + z + w + v[0] + u end;
+begin m := 5; q(); r(); s(); write n + m; write a[1] end.
+`,
+			want: "16 7 ",
+		},
+		{
+			name:  "read",
+			src:   "var x, y;\nbegin read x, y; write x + y end.\n",
+			input: "3 4\n",
+			want:  "7 ",
+		},
+	}
+	for _, f := range []codegen.Frame{codegen.DisplayFrame, codegen.StaticLinkFrame} {
+		codegen.SetFrame(f)
+		for _, tt := range tests {
+			t.Run(tt.name+"/"+f.String(), func(t *testing.T) {
+				if got := runSource(t, tt.src, tt.input); got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+	codegen.SetFrame(codegen.DisplayFrame)
+}
+
+// 実行時エラーの呼び出しの列は、内部関数から外側の関数を呼んでも関数名と実引数を示す
+// エラーの位置は演算子、呼び出しの位置は関数名のもの
+func TestRuntimeError(t *testing.T) {
+	src := `function outer(n)
+  function inner(k) begin return outer(k - 1) end;
+begin
+  if n = 0 then return 1 / n;
+  return inner(n)
+end;
+begin write outer(1) end.
+`
+	prog, err := compileSource(t, t.TempDir(), "prog.pl0", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = codegen.NewVM(&out, strings.NewReader(""), nil).Run(prog)
+	var e *codegen.RuntimeError
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want a runtime error", err)
+	}
+	var calls []string
+	for _, f := range e.Stack {
+		calls = append(calls, fmt.Sprintf("%s%v@%d:%d", f.Func, f.Args, f.Pos.Pos.Line, f.Pos.Pos.Col+1))
+	}
+	want := "outer[0]@4:26 inner[1]@2:34 outer[1]@5:10 main[]@7:13"
+	if got := strings.Join(calls, " "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// 同じプロセスで何度コンパイルしても前のコンパイルの状態は残らない
+func TestCompileTwice(t *testing.T) {
+	dir := t.TempDir()
+	lib := "const ten = 10;\nfunction twice(x) begin return x * 2 end;\n.\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.pl0"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := "import \"lib.pl0\";\nbegin write lib.twice(lib.ten) end.\n"
+	for i := 0; i < 2; i++ {
+		if _, err := compileSource(t, dir, "main.pl0", main); err != nil {
+			t.Fatalf("compile %d: %s", i+1, err)
+		}
+	}
+	if _, err := compileSource(t, dir, "bad.pl0", "begin write x end.\n"); err == nil {
+		t.Fatal("undefined name compiled without errors")
+	}
+	if _, err := compileSource(t, dir, "plain.pl0", "var x;\nbegin x := 1; write x end.\n"); err != nil {
+		t.Fatalf("compile after an error: %s", err)
+	}
+}
+
+// ファイルの終わりでコンパイルが途中で終わってもエラーを返し、次のコンパイルはできる
+func TestAbort(t *testing.T) {
+	dir := t.TempDir()
+	prog, err := compileSource(t, dir, "eof.pl0", "var x;\nbegin x := 1 write x end\n")
+	if err == nil || prog != nil {
+		t.Fatalf("got %v, %v, want an aborted compilation", prog, err)
+	}
+	if n := len(getsource.Repairs()); n != 1 {
+		t.Errorf("got %d repairs, want 1", n)
+	}
+	if _, err := compileSource(t, dir, "plain.pl0", "var x;\nbegin x := 1; write x end.\n"); err != nil {
+		t.Fatalf("compile after an aborted compilation: %s", err)
+	}
+}
+
+// forward 宣言した関数の有効範囲は、本体のものと合わせて 1 つ
+func TestForwardScope(t *testing.T) {
+	src := "function f(n) forward;\nfunction g(n) begin return f(n) end;\nfunction f(n) begin return n end;\nbegin write g(1) end.\n"
+	if _, err := compileSource(t, t.TempDir(), "prog.pl0", src); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range table.Root().Children {
+		names = append(names, s.Name())
+	}
+	if got := strings.Join(names, " "); got != "g f" {
+		t.Errorf("got scopes %q, want %q", got, "g f")
+	}
+}
+
+// 相互参照表には、有効範囲ごとに名前の宣言と使用の位置が並ぶ
+func TestXref(t *testing.T) {
+	dir := t.TempDir()
+	src := "const n = 3;\nvar x, a[2];\nfunction f(k) begin return k * n end;\nbegin x := f(2); a[0] := x; write a[0] end.\n"
+	if _, err := compileSource(t, dir, "prog.pl0", src); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "prog.pl0")
+	want := fmt.Sprintf(`main (level 0, %s)
+  n  const  0  value 3    1:7   read 3:32
+  x  var    0  addr 2     2:5   read 4:26  write 4:7
+  a  array  0  addr 3[2]  2:8   read 4:35  write 4:18
+  f  func   0  code 2     3:10  call 4:12
+f (level 1, %s)
+  k  par  1  addr -1  3:12  read 3:28
+`, file, file)
+	var out bytes.Buffer
+	table.WriteXref(&out)
+	if got := out.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// case 文は、ラベルが密なら飛び先表、疎なら比較の列にする
+func TestCase(t *testing.T) {
+	tests := []struct {
+		name  string
+		arms  string // 選択肢
+		input string // 選択子の値
+		want  string
+		table bool // 飛び先表 (jix 命令) を使うか
+	}{
+		{"dense", "1: write 10; 2, 3: write 20; 5: write 50", "0 1 2 3 4 5 6", "0 10 20 20 0 50 0 ", true},
+		{"negative", "-1: write 10; 0: write 20; 1: write 30", "-2 -1 0 1 2", "0 10 20 30 0 ", true},
+		{"sparse", "1: write 10; 100: write 20; 1000: write 30", "1 2 100 1000", "10 0 20 30 ", false},
+		{"wide", "-2 ** 62: write 10; 0: write 20; 2 ** 62: write 30", "0 1 4611686018427387904", "20 0 30 ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := len(strings.Fields(tt.input))
+			src := fmt.Sprintf("var i, x;\nbegin i := 0;\nwhile i < %d do begin\n  read x;\n  case x of %s else write 0 end;\n  i := i + 1\nend end.\n", n, tt.arms)
+			prog, err := compileSource(t, t.TempDir(), "prog.pl0", src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table := false
+			for _, c := range prog.Code {
+				table = table || c.Op == codegen.Jix
+			}
+			if table != tt.table {
+				t.Errorf("got jump table %v, want %v", table, tt.table)
+			}
+			var out bytes.Buffer
+			if err := codegen.NewVM(&out, strings.NewReader(tt.input), nil).Run(prog); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// コンパイルのエラーの数と、 .tex ファイルに出力した警告の数
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		errors   int
+		warnings int
+	}{
+		{"value dropped", "function f() begin return 1 end;\nbegin call f(); f() end.\n", 0, 2},
+		{"procedure in expression", "var x;\nprocedure p() begin x := 1 end;\nbegin x := p() end.\n", 1, 0},
+		{"procedure returns a value", "procedure p() begin return 1 end;\nbegin p() end.\n", 1, 0},
+		{"break outside a loop", "begin break end.\n", 1, 0},
+		{"continue outside a loop", "var x;\nbegin if x = 0 then continue end.\n", 1, 0},
+		{"duplicate var", "var x, x;\nbegin end.\n", 1, 0},
+		{"duplicate const and var", "const c = 1; var c;\nbegin end.\n", 1, 0},
+		{"duplicate parameter", "function f(a, a) begin return a end;\nbegin end.\n", 1, 0},
+		{"duplicate function", "var f;\nfunction f() begin return 1 end;\nbegin end.\n", 1, 0},
+		{"shadow outer name", "var x;\nfunction f() var x; begin x := 1; return x end;\nbegin x := f() end.\n", 0, 1},
+		{"shadow parameter", "function f(a) var a; begin a := 1; return a end;\nbegin write f(1) end.\n", 0, 1},
+		{"parameter shadows outer name", "var a;\nfunction f(a) begin return a end;\nbegin a := f(1) end.\n", 0, 1},
+		{"var argument is not a variable", "var u;\nprocedure swap(var a, b) var t; begin t := a; a := b; b := t end;\nbegin swap(u, 5) end.\n", 1, 0},
+		{"const overflow", "const a = 2 ** 63, b = 3 ** 40, c = -2 ** 62 * 2 - 1;\nbegin end.\n", 3, 0},
+		{"const div by 0", "const a = 1 / 0, b = 1 mod (1 - 1), c = 0 ** (-1);\nbegin end.\n", 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			compileSource(t, dir, "prog.pl0", tt.src)
+			if got := getsource.ErrorN(); got != tt.errors {
+				t.Errorf("got %d errors, want %d", got, tt.errors)
+			}
+			tex, err := os.ReadFile(filepath.Join(dir, "prog.pl0.tex"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(tex), "$^{\\it "); got != tt.warnings {
+				t.Errorf("got %d warnings, want %d", got, tt.warnings)
+			}
+		})
+	}
+}
+
+// 名前への書き込みの型の誤りは、使用ごとに書き込んだところでエラーになる
+func TestWriteType(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want int
+		mark string // .tex でエラーを付けたところ
+	}{
+		{"ok", "var x: integer; ok: boolean;\nbegin x := 1; ok := x > 0; read x end.\n", 0, ""},
+		{"assign", "var x: integer; ok: boolean;\nbegin x := ok; ok := 1; ok := x end.\n", 3, "1$^{ok\\ integer,\\ not\\ boolean}$$;$"},
+		{"read", "var ok: boolean;\nbegin read ok end.\n", 1, "{\\bf read}\\ \\(\\stackrel{\\mbox{\\scriptsize ok\\ integer,\\ not\\ boolean}}{\\mbox{ok}}\\)"},
+		{"var argument", "var ok: boolean;\nprocedure inc(var n) begin n := n + 1 end;\nbegin inc(ok) end.\n", 1, "{\\mbox{ok}}\\)$)$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			compileSource(t, dir, "prog.pl0", tt.src)
+			if got := getsource.ErrorN(); got != tt.want {
+				t.Errorf("got %d errors, want %d", got, tt.want)
+			}
+			tex, err := os.ReadFile(filepath.Join(dir, "prog.pl0.tex"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(tex), tt.mark) {
+				t.Errorf("mark %q not found in\n%s", tt.mark, tex)
+			}
+		})
+	}
+}
+
+// 文の区切りを忘れたときは、1 つのエラーとして回復する
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want int
+	}{
+		{"missing semicolon", "var x;\nbegin x := 1 x := 2 end.\n", 1},
+		{"missing semicolon before a split assignment", "var x, y;\nbegin x := 1 y\n  := 2 end.\n", 1},
+		{"missing do", "var x;\nbegin while x < 3 x := x + 1 end.\n", 1},
+		{"missing operator", "var x, y;\nbegin x := 1 y end.\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compileSource(t, t.TempDir(), "prog.pl0", tt.src)
+			if got := getsource.ErrorN(); got != tt.want {
+				t.Errorf("got %d errors, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// import したファイルの名前は、そのファイルで宣言したものだけが見える
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	libs := map[string]string{
+		"util.pl0": "function twice(x) begin return x * 2 end;\n.\n",
+		"lib.pl0":  "import \"util.pl0\";\nconst ten = 10;\nfunction four() begin return util.twice(2) end;\n.\n",
+	}
+	for name, src := range libs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		src  string
+		ok   bool
+	}{
+		{"own names", "import \"lib.pl0\";\nbegin write lib.ten + lib.four() end.\n", true},
+		{"imported twice", "import \"lib.pl0\";\nimport \"util.pl0\";\nbegin write util.twice(lib.ten) end.\n", true},
+		{"not transitive", "import \"lib.pl0\";\nbegin write util.twice(lib.ten) end.\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileSource(t, dir, "main.pl0", tt.src)
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package fix
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/is-hoku/pl0dash-go/getsource"
+)
+
+const CONTEXT int = 3 // diff の変更の前後に出す行数
+
+// ソースの位置 p のバイト位置
+func offset(starts []int, p getsource.Pos) int {
+	if p.Line < 1 || p.Line > len(starts) {
+		return starts[len(starts)-1]
+	}
+	return starts[p.Line-1] + p.Col
+}
+
+// 前後に空白のいらない記号か？
+func isPunct(text string) bool {
+	switch text {
+	case ";", ",", ".", "(", ")", "[", "]":
+		return true
+	default:
+		return false
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// ソース src にファイル file の修復 repairs を施したソースを返す
+// 挿入は前のトークンの直後に、削除はトークンとその前の空白を取り除く
+func Apply(src string, repairs []getsource.Repair, file string) string {
+	lines := strings.SplitAfter(src, "\n")
+	starts := make([]int, len(lines)) // 各行の先頭のバイト位置
+	for i := 1; i < len(lines); i++ {
+		starts[i] = starts[i-1] + len(lines[i-1])
+	}
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	for _, r := range repairs {
+		if r.File == file {
+			edits = append(edits, edit{offset(starts, r.Pos), offset(starts, r.End), r.Text})
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out []byte
+	cur := 0 // src のここまでは出力済み
+	for _, e := range edits {
+		if e.start < cur { // 削除したトークンの中
+			continue
+		}
+		if e.text == "" { // 削除
+			s := e.start
+			for s > cur && (src[s-1] == ' ' || src[s-1] == '\t') {
+				s--
+			}
+			out = append(out, src[cur:s]...)
+			cur = e.end
+			if s < e.start && len(out) > 0 && isWordChar(out[len(out)-1]) && cur < len(src) && isWordChar(src[cur]) {
+				out = append(out, ' ') // 前後のトークンがつながらないように空白を残す
+			}
+			continue
+		}
+		out = append(out, src[cur:e.start]...)
+		cur = e.start
+		if !isPunct(e.text) {
+			out = append(out, ' ')
+		}
+		out = append(out, e.text...)
+		if cur < len(src) && isWordChar(src[cur]) && isWordChar(e.text[len(e.text)-1]) {
+			out = append(out, ' ')
+		}
+	}
+	out = append(out, src[cur:]...)
+	return string(out)
+}
+
+// a から b への行単位の unified diff を返す、違いがなければ空
+func Diff(a string, b string, nameA string, nameB string) string {
+	x, y := splitLines(a), splitLines(b)
+	n, m := len(x), len(y)
+	lcs := make([][]int, n+1) // lcs[i][j] は x[i:] と y[j:] の最長共通部分列の長さ
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = lcs[i+1][j]
+				if lcs[i][j+1] > lcs[i][j] {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+	}
+	type op struct {
+		kind byte // ' ', '-', '+'
+		i, j int  // x, y の行番号 (0 から)
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && x[i] == y[j]:
+			ops = append(ops, op{' ', i, j})
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', i, j})
+			j++
+		}
+	}
+	var out strings.Builder
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+		// 変更の前後 CONTEXT 行を含む範囲をひとつの hunk にする
+		first := k - CONTEXT
+		if first < 0 {
+			first = 0
+		}
+		last := k
+		for p := k; p < len(ops) && p <= last+2*CONTEXT; p++ {
+			if ops[p].kind != ' ' {
+				last = p
+			}
+		}
+		end := last + CONTEXT + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		var body strings.Builder
+		na, nb := 0, 0
+		for _, o := range ops[first:end] {
+			switch o.kind {
+			case ' ':
+				body.WriteString(" " + x[o.i] + "\n")
+				na++
+				nb++
+			case '-':
+				body.WriteString("-" + x[o.i] + "\n")
+				na++
+			case '+':
+				body.WriteString("+" + y[o.j] + "\n")
+				nb++
+			}
+		}
+		if out.Len() == 0 {
+			out.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", nameA, nameB))
+		}
+		out.WriteString(fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(ops[first].i, na), hunkRange(ops[first].j, nb)))
+		out.WriteString(body.String())
+		k = end
+	}
+	return out.String()
+}
+
+// hunk の範囲 start,count (行番号は 1 から、空の範囲はその直前の行)
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// 行に分ける、最後の改行の後は行にしない
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
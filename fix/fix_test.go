@@ -0,0 +1,88 @@
+package fix
+
+import (
+	"testing"
+
+	"github.com/is-hoku/pl0dash-go/getsource"
+)
+
+// 行 line の桁 col (0 から) の位置
+func pos(line int, col int) getsource.Pos {
+	return getsource.Pos{Line: line, Col: col}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		repairs []getsource.Repair
+		want    string
+	}{
+		{
+			name:    "insert",
+			src:     "var x;\nbegin x := 1 x := 2 end.\n",
+			repairs: []getsource.Repair{{File: "a.pl0", Pos: pos(2, 12), End: pos(2, 12), Text: ";"}},
+			want:    "var x;\nbegin x := 1; x := 2 end.\n",
+		},
+		{
+			name:    "insert keyword",
+			src:     "begin while x < 3 x := 1 end.\n",
+			repairs: []getsource.Repair{{File: "a.pl0", Pos: pos(1, 17), End: pos(1, 17), Text: "do"}},
+			want:    "begin while x < 3 do x := 1 end.\n",
+		},
+		{
+			name:    "delete",
+			src:     "begin x := 1 ) end.\n",
+			repairs: []getsource.Repair{{File: "a.pl0", Pos: pos(1, 13), End: pos(1, 14), Text: ""}},
+			want:    "begin x := 1 end.\n",
+		},
+		{
+			name:    "other file",
+			src:     "begin x := 1 x := 2 end.\n",
+			repairs: []getsource.Repair{{File: "lib.pl0", Pos: pos(1, 12), End: pos(1, 12), Text: ";"}},
+			want:    "begin x := 1 x := 2 end.\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Apply(tt.src, tt.repairs, "a.pl0"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"same", "a\nb\n", "a\nb\n", ""},
+		{
+			name: "change",
+			a:    "1\n2\n3\n4\n5\n",
+			b:    "1\n2\nx\n4\n5\n",
+			want: "--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n 2\n-3\n+x\n 4\n 5\n",
+		},
+		{
+			name: "insert",
+			a:    "1\n",
+			b:    "0\n1\n",
+			want: "--- a\n+++ b\n@@ -1 +1,2 @@\n+0\n 1\n",
+		},
+		{
+			name: "two hunks",
+			a:    "a\n1\n2\n3\n4\n5\n6\n7\n8\nb\n",
+			b:    "A\n1\n2\n3\n4\n5\n6\n7\n8\nB\n",
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.a, tt.b, "a", "b"); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
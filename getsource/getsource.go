@@ -16,38 +16,46 @@ const INSERT_C string = "#0000FF" // 挿入文字の色
 const DELETE_C string = "#FF0000" // 削除文字の色
 const TYPE_C string = "#00FF00"   // タイプエラー文字の色
 
+const ABORT string = "abort compilation" // コンパイルを途中で終えるときの panic の値
+
 // var fpi *os.File           // ソースファイル
 // var scanner *bufio.Scanner // ファイルを 1 行ずつ読むスキャナ
 // var fptex *os.File     // LaTex 出力ファイル
 // var line [MAXLINE]byte // 1 行分の入力バッファ
-var line string     // 1 行分の入力バッファ
-var lineIndex int   // 次に読む文字の位置
-var ch byte         // 最後に読んだ文字
-var cToken Token    // 最後に読んだトークン
-var idKind KindT    // 現トークンの種類
-var spaces int      // そのトークンの前のスペースの個数
-var cr int          // その前の CR の個数
-var printed bool    // トークンは印字済みか
-var errorNo int = 0 // 出力したエラーの数
+var line string      // 1 行分の入力バッファ
+var lineIndex int    // 次に読む文字の位置
+var ch byte          // 最後に読んだ文字
+var cToken Token     // 最後に読んだトークン
+var idKind KindT     // 現トークンの種類
+var spaces int       // そのトークンの前のスペースの個数
+var cr int           // その前の CR の個数
+var printed bool     // トークンは印字済みか
+var errorNo int = 0  // 出力したエラーの数
+var tokenNo int      // 読んだトークンの数
+var errorAt int = -1 // このトークンまでのエラーは最後に数えたエラーの修復の続き
+var fileName string  // 読んでいるソースファイルの名前
+var lineNo int       // 読んでいる行の番号 (1 から)
+var chPos Pos        // 最後に読んだ文字の位置
+var tokenPos Pos     // 現トークンの先頭の位置
+var tokenEnd Pos     // 現トークンの直後の位置
+var prevEnd Pos      // 前のトークンの直後の位置
+var repairs []Repair // エラーの修復 (記号の挿入とトークンの削除)
 
 type KeyID int // キーの文字の種類
 
+type lookahead struct { // 先読みしたトークンとその前の空白
+	token    Token
+	spaces   int
+	cr       int
+	pos, end Pos
+}
+
+var peeked *lookahead // PeekToken で先読みしたトークン
+
 type RelAddr struct { // 変数・パラメタ・関数のアドレスの型
 	Level int
 	Addr  int
 }
-type TableE struct {
-	Kind KindT  // 名前の種類
-	Name string // 名前のつづり
-	U    struct {
-		Value int // 定数の場合：値
-		F     struct {
-			Raddr RelAddr // 関数の場合：先頭アドレス
-			Pars  int     // 関数の場合：パラメタ数
-		}
-		Raddr RelAddr // 変数・パラメタの場合：アドレス
-	}
-}
 
 type KindT int // Identifier の種類
 
@@ -56,6 +64,9 @@ const (
 	FuncID
 	ParID
 	ConstID
+	ProcID
+	ArrayID
+	RefID
 )
 
 func (k KindT) String() string {
@@ -68,11 +79,36 @@ func (k KindT) String() string {
 		return "par"
 	case ConstID:
 		return "const"
+	case ProcID:
+		return "proc"
+	case ArrayID:
+		return "array"
+	case RefID:
+		return "ref"
 	default:
 		return "unknown"
 	}
 }
 
+type TypeT int // 値の型
+
+const (
+	IntType  TypeT = iota // 整数 (型を書かなければこれ)
+	BoolType              // 真理値
+	NoType                // 型がない (手続きの結果、エラーの後の式)
+)
+
+func (t TypeT) String() string {
+	switch t {
+	case IntType:
+		return "integer"
+	case BoolType:
+		return "boolean"
+	default:
+		return "none"
+	}
+}
+
 const (
 	Begin KeyID = iota
 	End
@@ -87,6 +123,27 @@ const (
 	Odd
 	Write
 	WriteLn
+	Proc
+	Call
+	And
+	Or
+	Not
+	Mod
+	IDiv
+	Read
+	ReadLn
+	Case
+	Of
+	Else
+	Break
+	Continue
+	Exit
+	Forward
+	Import
+	Integer
+	Boolean
+	True
+	False
 	End_of_KeyWd // 予約語の名前はここまで
 	Plus
 	Minus
@@ -104,14 +161,19 @@ const (
 	Period
 	Semicolon
 	Assign
+	Power
+	Colon
+	Lbracket
+	Rbracket
 	End_of_KeySym // 演算子と区切り記号の名前はここまで
 	Id
 	Num
+	Str
 	Nul
 	End_of_Token
 	Letter
 	Digit
-	Colon
+	Quote
 	Others
 )
 
@@ -143,6 +205,48 @@ func (k KeyID) String() string {
 		return "write"
 	case WriteLn:
 		return "writeln"
+	case Proc:
+		return "proc"
+	case Call:
+		return "call"
+	case And:
+		return "and"
+	case Or:
+		return "or"
+	case Not:
+		return "not"
+	case Mod:
+		return "mod"
+	case IDiv:
+		return "idiv"
+	case Read:
+		return "read"
+	case ReadLn:
+		return "readln"
+	case Case:
+		return "case"
+	case Of:
+		return "of"
+	case Else:
+		return "else"
+	case Break:
+		return "break"
+	case Continue:
+		return "continue"
+	case Exit:
+		return "exit"
+	case Forward:
+		return "forward"
+	case Import:
+		return "import"
+	case Integer:
+		return "integer"
+	case Boolean:
+		return "boolean"
+	case True:
+		return "true"
+	case False:
+		return "false"
 	case Plus:
 		return "plus"
 	case Minus:
@@ -175,18 +279,28 @@ func (k KeyID) String() string {
 		return "semicolon"
 	case Assign:
 		return "assign"
+	case Power:
+		return "power"
+	case Colon:
+		return "colon"
+	case Lbracket:
+		return "lbracket"
+	case Rbracket:
+		return "rbracket"
 	case Id:
 		return "id"
 	case Num:
 		return "num"
+	case Str:
+		return "str"
 	case Nul:
 		return "nul"
 	case Letter:
 		return "letter"
 	case Digit:
 		return "digit"
-	case Colon:
-		return "colon"
+	case Quote:
+		return "quote"
 	case Others:
 		return "others"
 	default:
@@ -194,6 +308,51 @@ func (k KeyID) String() string {
 	}
 }
 
+// ソースの中の位置
+type Pos struct {
+	Line int // 行番号 (1 から)
+	Col  int // 行の先頭からのバイト数 (0 から)
+}
+
+// コンパイラの決めたエラーの修復、 Text が空ならトークンの削除
+type Repair struct {
+	File string // ソースファイルの名前
+	Pos  Pos    // 挿入する位置か削除するトークンの先頭
+	End  Pos    // 削除するトークンの直後 (挿入では Pos と同じ)
+	Text string // 挿入する記号
+}
+
+// 名前の使い方
+type UseKind int
+
+const (
+	ReadUse  UseKind = iota // 値の参照
+	WriteUse                // 代入や read 文、参照渡しの実引数
+	CallUse                 // 関数・手続きの呼び出し
+)
+
+func (u UseKind) String() string {
+	switch u {
+	case ReadUse:
+		return "read"
+	case WriteUse:
+		return "write"
+	case CallUse:
+		return "call"
+	default:
+		return "unknown"
+	}
+}
+
+// 名前の使用
+type Use struct {
+	File string  // ソースファイルの名前
+	Pos  Pos     // 名前の位置
+	End  Pos     // 名前の直後の位置
+	Kind UseKind // 使い方
+	Type TypeT   // 書き込みなら書き込む値の型、わからなければ NoType
+}
+
 type IDVal struct {
 	ID    string
 	Value int
@@ -202,6 +361,7 @@ type IDVal struct {
 type Token struct {
 	Kind KeyID
 	U    IDVal
+	Pos  Pos // トークンの先頭の位置
 }
 
 // 予約語や記号と名前
@@ -225,6 +385,27 @@ var keyWdT []*keyWd = []*keyWd{
 	{"odd", Odd},
 	{"write", Write},
 	{"writeln", WriteLn},
+	{"procedure", Proc},
+	{"call", Call},
+	{"and", And},
+	{"or", Or},
+	{"not", Not},
+	{"mod", Mod},
+	{"div", IDiv},
+	{"read", Read},
+	{"readln", ReadLn},
+	{"case", Case},
+	{"of", Of},
+	{"else", Else},
+	{"break", Break},
+	{"continue", Continue},
+	{"exit", Exit},
+	{"forward", Forward},
+	{"import", Import},
+	{"integer", Integer},
+	{"boolean", Boolean},
+	{"true", True},
+	{"false", False},
 	{"$dummy1", End_of_KeyWd},
 	{"+", Plus},
 	{"-", Minus},
@@ -242,6 +423,10 @@ var keyWdT []*keyWd = []*keyWd{
 	{".", Period},
 	{";", Semicolon},
 	{":=", Assign},
+	{"**", Power},
+	{":", Colon},
+	{"[", Lbracket},
+	{"]", Rbracket},
 	{"$dummy2", End_of_KeySym},
 }
 
@@ -288,26 +473,69 @@ func initCharClassT() {
 	charClassT['.'] = Period
 	charClassT[';'] = Semicolon
 	charClassT[':'] = Colon
+	charClassT['"'] = Quote
+	charClassT['['] = Lbracket
+	charClassT[']'] = Rbracket
 }
 
-func OpenSource(fileName string) (*os.File, *bufio.Scanner, error) {
-	fpi, err := os.Open(fileName)
+func OpenSource(name string) (*os.File, *bufio.Scanner, error) {
+	fpi, err := os.Open(name)
 	if err != nil {
 		return nil, nil, err
 	}
-	texFileName := fileName + ".tex"
+	texFileName := name + ".tex"
 	fptex, err := os.Create(texFileName)
 	if err != nil {
 		return nil, nil, err
 	}
 	scanner := bufio.NewScanner(fpi)
+	fileName = name
 	return fptex, scanner, nil
 }
 
+// 読んでいるソースファイルの名前を返す
+func FileName() string {
+	return fileName
+}
+
+// 読んでいるソースの状態 (import で別のファイルを読む間退避しておく)
+type SourceState struct {
+	fileName  string
+	line      string
+	lineIndex int
+	ch        byte
+	cToken    Token
+	idKind    KindT
+	spaces    int
+	cr        int
+	printed   bool
+	lineNo    int
+	chPos     Pos
+	tokenPos  Pos
+	tokenEnd  Pos
+	prevEnd   Pos
+	peeked    *lookahead
+}
+
+// 読んでいるソースの状態を返す
+func SaveSource() SourceState {
+	return SourceState{fileName, line, lineIndex, ch, cToken, idKind, spaces, cr, printed, lineNo, chPos, tokenPos, tokenEnd, prevEnd, peeked}
+}
+
+// SaveSource で退避したソースの状態に戻す
+func RestoreSource(s SourceState) {
+	fileName, line, lineIndex, ch, cToken, idKind, spaces, cr, printed = s.fileName, s.line, s.lineIndex, s.ch, s.cToken, s.idKind, s.spaces, s.cr, s.printed
+	lineNo, chPos, tokenPos, tokenEnd, prevEnd, peeked = s.lineNo, s.chPos, s.tokenPos, s.tokenEnd, s.prevEnd, s.peeked
+}
+
 func InitSource(fptex *os.File) {
 	lineIndex = -1
+	lineNo = 0
 	ch = '\n'
-	printed = false
+	spaces = 0
+	cr = 0
+	peeked = nil
+	printed = true // 最初のトークンの前に印字するものはない
 	initCharClassT()
 	fptex.WriteString("\\documentstyle[12pt]{article}\n")
 	fptex.WriteString("\\begin{document}\n")
@@ -327,11 +555,16 @@ func FinalSource(fptex *os.File) {
 }
 
 // エラーが多いと終了 (panic)
+// 同じトークンでのエラー (挿入と削除の組など) はひとつの誤りの修復として 1 つと数える
 func errorNocheck(fptex *os.File) {
+	if tokenNo <= errorAt {
+		return
+	}
+	errorAt = tokenNo
 	errorNo++
 	if errorNo > MAXERROR {
 		fptex.WriteString("too many errors\n\\end{document}\n")
-		panic("abort compilation")
+		panic(ABORT)
 	}
 }
 
@@ -344,8 +577,9 @@ func ErrorType(m string, fptex *os.File) {
 	errorNocheck(fptex)
 }
 
-// keyString(k) を .tex ファイルに挿入
+// keyString(k) を .tex ファイルに挿入、修復としては前のトークンの直後に挿入する
 func ErrorInsert(k KeyID, fptex *os.File) {
+	repairs = append(repairs, Repair{fileName, prevEnd, prevEnd, keyWdT[k].word})
 	if k < End_of_KeyWd { // 予約語
 		fptex.WriteString(fmt.Sprintf("\\ \\insert{{\\bf %s}}", keyWdT[k].word))
 	} else { // 演算子か区切り記号
@@ -369,6 +603,7 @@ func ErrorMissingOp(fptex *os.File) {
 // 今読んだトークンを読み捨てる
 func ErrorDelete(fptex *os.File) {
 	i := cToken.Kind
+	repairs = append(repairs, Repair{fileName, tokenPos, tokenEnd, ""})
 	printSpaces(fptex)
 	printed = true
 	if i < End_of_KeyWd { // 予約語
@@ -379,7 +614,11 @@ func ErrorDelete(fptex *os.File) {
 		fptex.WriteString(fmt.Sprintf("\\delete{%s}", cToken.U.ID))
 	} else if i == Num {
 		fptex.WriteString(fmt.Sprintf("\\delete{%s}", strconv.Itoa(cToken.U.Value)))
+	} else if i == Str {
+		fptex.WriteString(fmt.Sprintf("\\delete{{\\tt \"%s\"}}", cToken.U.ID))
 	}
+	errorNocheck(fptex)
+	errorAt = tokenNo + 1 // 続けて読み捨てるトークンも同じ誤りの修復
 }
 
 // エラーメッセージを .tex ファイルに出力
@@ -388,14 +627,39 @@ func ErrorMessage(m string, fptex *os.File) {
 	errorNocheck(fptex)
 }
 
+// 警告メッセージを .tex ファイルに出力 (エラーの数には数えない)
+func WarningMessage(m string, fptex *os.File) {
+	fptex.WriteString(fmt.Sprintf("$^{\\it %s}$", m))
+}
+
 // エラーメッセージを出力しコンパイル終了
 func ErrorF(m string, fptex *os.File) {
 	ErrorMessage(m, fptex)
 	fptex.WriteString("fatal errors\n\\end{document}\n")
 	if errorNo != 0 {
-		fmt.Printf("total %d errors\n", errorNo)
+		fmt.Fprintf(os.Stderr, "total %d errors\n", errorNo) // fix の出力に混ぜない
 	}
-	panic("abort compilation\n")
+	panic(ABORT)
+}
+
+// 現トークンの先頭の位置を返す
+func TokenPos() Pos {
+	return tokenPos
+}
+
+// 現トークンの直後の位置を返す
+func TokenEnd() Pos {
+	return tokenEnd
+}
+
+// 前のトークンの直後の位置を返す
+func PrevEnd() Pos {
+	return prevEnd
+}
+
+// エラーの修復を出てきた順に返す
+func Repairs() []Repair {
+	return repairs
 }
 
 // エラーの個数を返す
@@ -403,6 +667,12 @@ func ErrorN() int {
 	return errorNo
 }
 
+// エラーの個数と修復を空にする (import したファイルではなく、コンパイルの始まりで呼ぶ)
+func ResetErrors() {
+	errorNo = 0
+	repairs = nil
+}
+
 // 次の 1 文字を返す
 func nextChar(scanner *bufio.Scanner, fptex *os.File) byte {
 	var ch byte
@@ -410,30 +680,71 @@ func nextChar(scanner *bufio.Scanner, fptex *os.File) byte {
 		if (scanner.Scan()) && (len(scanner.Text()) <= 120) {
 			line = scanner.Text()
 			lineIndex = 0
+			lineNo++
 		} else {
 			ErrorF("end of file\n", fptex)
 		}
 	}
 	if lineIndex >= len(line) {
+		chPos = Pos{lineNo, len(line)}
 		lineIndex = -1
 		return '\n'
 	}
+	chPos = Pos{lineNo, lineIndex}
 	ch = line[lineIndex]
 	lineIndex++
 	return ch
 }
 
+// 次に読む文字を読まずに返す
+func peekChar() byte {
+	if lineIndex < 0 || lineIndex >= len(line) {
+		return '\n'
+	}
+	return line[lineIndex]
+}
+
 func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
+	printcToken(fptex) // 前のトークンを印字
+	tokenNo++
+	prevEnd = tokenEnd
+	if p := peeked; p != nil { // 先読みしたトークン
+		peeked = nil
+		cToken, spaces, cr, tokenPos, tokenEnd = p.token, p.spaces, p.cr, p.pos, p.end
+	} else {
+		spaces = 0
+		cr = 0
+		cToken = scanToken(scanner, fptex)
+		tokenEnd = chPos // 先読みした文字の位置がトークンの直後
+	}
+	printed = false
+	return cToken
+}
+
+// 次のトークンを読まずに返す、現トークンとその印字はそのまま
+// 先読みしたトークンの字句のエラーは現トークンの前に印字される
+func PeekToken(scanner *bufio.Scanner, fptex *os.File) Token {
+	if peeked == nil {
+		s, c, pos := spaces, cr, tokenPos
+		spaces = 0
+		cr = 0
+		tokenNo++ // 字句のエラーは先読みしたトークンのエラー
+		t := scanToken(scanner, fptex)
+		tokenNo--
+		peeked = &lookahead{t, spaces, cr, tokenPos, chPos}
+		spaces, cr, tokenPos = s, c, pos
+	}
+	return peeked.token
+}
+
+// 空白と改行を数えながら読み飛ばし、次のトークンを切り出す
+func scanToken(scanner *bufio.Scanner, fptex *os.File) Token {
 	var i int = 0
 	var num int
 	var cc KeyID
 	var temp Token
 	var ident string
 
-	printcToken(fptex) // 前のトークンを印字
-	spaces = 0
-	cr = 0
-
 	for { // 次のトークンまでの空白や改行をカウント
 		if ch == ' ' {
 			spaces++
@@ -448,6 +759,8 @@ func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
 		ch = nextChar(scanner, fptex)
 	}
 
+	tokenPos = chPos
+	temp.Pos = chPos
 	cc = charClassT[ch]
 	switch cc {
 	case Letter: // identifier
@@ -460,6 +773,9 @@ func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
 			if charClassT[ch] == Letter || charClassT[ch] == Digit {
 				continue
 			}
+			if ch == '.' && charClassT[peekChar()] == Letter { // lib.name の形の名前
+				continue
+			}
 			break
 		}
 		if i >= MAXNAME {
@@ -470,8 +786,6 @@ func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
 			// 予約語の場合
 			if ident == keyWdT[i].word {
 				temp.Kind = keyWdT[i].keyID
-				cToken = temp
-				printed = false
 				return temp
 			}
 		}
@@ -496,12 +810,26 @@ func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
 		temp.Kind = Num
 		temp.U.Value = num
 
+	case Quote: // string
+		for ch = nextChar(scanner, fptex); ch != '"'; ch = nextChar(scanner, fptex) {
+			if ch == '\n' { // 文字列は 1 行に収める
+				ErrorMessage("unterminated string", fptex)
+				break
+			}
+			ident += string(ch)
+		}
+		if ch == '"' {
+			ch = nextChar(scanner, fptex)
+		}
+		temp.Kind = Str
+		temp.U.ID = ident
+
 	case Colon:
 		if ch = nextChar(scanner, fptex); ch == '=' { // :=
 			ch = nextChar(scanner, fptex)
 			temp.Kind = Assign
 		} else {
-			temp.Kind = Nul
+			temp.Kind = Colon
 		}
 
 	case Lss:
@@ -515,6 +843,14 @@ func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
 			temp.Kind = Lss
 		}
 
+	case Mult:
+		if ch = nextChar(scanner, fptex); ch == '*' { // **
+			ch = nextChar(scanner, fptex)
+			temp.Kind = Power
+		} else {
+			temp.Kind = Mult
+		}
+
 	case Gtr:
 		if ch = nextChar(scanner, fptex); ch == '=' { // >=
 			ch = nextChar(scanner, fptex)
@@ -527,9 +863,6 @@ func NextToken(scanner *bufio.Scanner, fptex *os.File) Token {
 		temp.Kind = cc
 		ch = nextChar(scanner, fptex)
 	}
-
-	cToken = temp
-	printed = false
 	return temp
 }
 
@@ -580,17 +913,19 @@ func printcToken(fptex *os.File) {
 		fptex.WriteString(fmt.Sprintf("$%s$", keyWdT[i].word))
 	} else if i == int(Id) { // Identfier
 		switch idKind {
-		case VarID:
+		case VarID, ArrayID:
 			fptex.WriteString(fmt.Sprintf("%s", cToken.U.ID))
-		case ParID:
+		case ParID, RefID:
 			fptex.WriteString(fmt.Sprintf("{\\sl %s}", cToken.U.ID))
-		case FuncID:
+		case FuncID, ProcID:
 			fptex.WriteString(fmt.Sprintf("{\\it %s}", cToken.U.ID))
 		case ConstID:
 			fptex.WriteString(fmt.Sprintf("{\\sf %s}", cToken.U.ID))
 		}
 	} else if i == int(Num) {
 		fptex.WriteString(fmt.Sprintf("%d", cToken.U.Value))
+	} else if i == int(Str) {
+		fptex.WriteString(fmt.Sprintf("{\\tt \"%s\"}", cToken.U.ID))
 	}
 }
 
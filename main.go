@@ -1,35 +1,290 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/is-hoku/pl0dash-go/codegen"
 	"github.com/is-hoku/pl0dash-go/compile"
+	"github.com/is-hoku/pl0dash-go/fix"
 	"github.com/is-hoku/pl0dash-go/getsource"
+	"github.com/is-hoku/pl0dash-go/table"
 )
 
+const ASMEXT string = ".pl0s" // アセンブラのファイルの拡張子
+
+// サブコマンド
+var commands = map[string]func(args []string) error{
+	"run":    run,
+	"build":  build,
+	"disasm": disasm,
+	"asm":    asm,
+	"fix":    fixSource,
+	"xref":   xref,
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		err := errors.New("invalid argument length")
+	args := os.Args[1:]
+	cmd := run // サブコマンドを省略したら run
+	if len(args) > 0 {
+		if c, ok := commands[args[0]]; ok {
+			cmd = c
+			args = args[1:]
+		}
+	}
+	if err := cmd(args); err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
+	}
+}
+
+// run: コンパイルしてエラーがなければ実行する、目的プログラムのファイル (.pl0c) ならそのまま実行する
+func run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	inputName := flags.String("i", "", "read 文の入力ファイル (省略時は標準入力)")
+	frameName := flags.String("frame", "display", "外側のブロックの変数のたどり方 (display か static)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("invalid argument length")
+	}
+	if err := setFrame(*frameName); err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if *inputName != "" {
+		fpin, err := os.Open(*inputName)
+		if err != nil {
+			return errors.New(fmt.Sprintf("cannot open the input file: %s", err))
+		}
+		defer fpin.Close()
+		in = fpin
+	}
+	prog, err := load(flags.Arg(0), os.Stderr) // 状態の出力はプログラムの出力に混ぜない
+	if err != nil {
+		return err
+	}
+	vm := codegen.NewVM(os.Stdout, in, log.New(os.Stderr, "", 0))
+	if err := vm.Run(prog); err != nil {
+		return errors.New(fmt.Sprintf("Error: %s", err))
+	}
+	return nil
+}
+
+// ファイル fileName の目的プログラムを返す
+// 目的プログラムのファイルはそのまま読み、アセンブラ (.pl0s) はアセンブルし、ソースならコンパイルする (その旨を w に出力)
+func load(fileName string, w io.Writer) (*codegen.Program, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot open the file: %s", err))
+	}
+	if codegen.IsBytecode(data) {
+		return codegen.ReadProgram(data)
+	}
+	if filepath.Ext(fileName) == ASMEXT {
+		return codegen.Assemble(bytes.NewReader(data), fileName)
 	}
-	fileName := os.Args[1]
+	return compileFile(fileName, w)
+}
+
+// ソースファイル fileName をコンパイルする (その旨を w に出力)
+func compileFile(fileName string, w io.Writer) (*codegen.Program, error) {
+	fmt.Fprintln(w, "start compilation")
 	tex, scanner, err := getsource.OpenSource(fileName)
 	if err != nil {
-		err := errors.New(fmt.Sprintf("cannot open the file: %s", err))
-		fmt.Println(err)
-		return
+		return nil, errors.New(fmt.Sprintf("cannot open the file: %s", err))
 	}
 	defer tex.Close()
-	if err := compile.Compile(tex, scanner); err != nil {
-		codegen.Execute(tex)
+	return compile.Compile(tex, scanner)
+}
+
+// build: コンパイルして目的プログラムをファイル (.pl0c) に書き出す
+func build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	frameName := flags.String("frame", "display", "外側のブロックの変数のたどり方 (display か static)")
+	outName := flags.String("o", "", "出力ファイル (省略時はソースの拡張子を .pl0c にしたもの)")
+	strip := flags.Bool("strip", false, "デバッグ情報 (命令語ごとのソースの位置) を書き出さない")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("invalid argument length")
 	}
+	if err := setFrame(*frameName); err != nil {
+		return err
+	}
+	fileName := flags.Arg(0)
+	prog, err := compileFile(fileName, os.Stdout)
 	if err != nil {
-		err := errors.New(fmt.Sprintf("Error: %s", err))
-		fmt.Println(err)
-		return
+		return err
+	}
+	return writeProgram(prog, fileName, *outName, !*strip)
+}
+
+// 目的プログラム prog をファイル outName (空ならソース fileName の拡張子を .pl0c にしたもの) に書き出す
+func writeProgram(prog *codegen.Program, fileName string, outName string, debug bool) error {
+	if outName == "" {
+		outName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".pl0c"
+	}
+	out, err := os.Create(outName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot write the file: %s", err))
+	}
+	defer out.Close()
+	if err := codegen.WriteProgram(out, prog, debug); err != nil {
+		return errors.New(fmt.Sprintf("cannot write the file: %s", err))
+	}
+	return nil
+}
+
+// 名前 name のフレームの形式を codegen に設定する
+func setFrame(name string) error {
+	f, ok := codegen.ParseFrame(name)
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown frame: %s", name))
+	}
+	codegen.SetFrame(f)
+	return nil
+}
+
+// fix: コンパイラの決めた修復 (記号の挿入とトークンの削除) をソースに施したプログラムを出力する
+func fixSource(args []string) error {
+	flags := flag.NewFlagSet("fix", flag.ExitOnError)
+	diff := flags.Bool("diff", false, "修正したプログラムの代わりに unified diff を出力")
+	outName := flags.String("o", "", "出力ファイル (省略時は標準出力)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("invalid argument length")
+	}
+	fileName := flags.Arg(0)
+	src, err := os.ReadFile(fileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot open the file: %s", err))
+	}
+	tex, scanner, err := getsource.OpenSource(fileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot open the file: %s", err))
+	}
+	defer tex.Close()
+	if _, err := compile.Compile(tex, scanner); err != nil {
+		fmt.Fprintln(os.Stderr, err) // エラーの数
+	}
+	fixed := fix.Apply(string(src), getsource.Repairs(), fileName) // 途中で終わっても、それまでの修復は施す
+	out := fixed
+	if *diff {
+		out = fix.Diff(string(src), fixed, fileName, fileName)
+	}
+	if *outName == "" {
+		fmt.Print(out)
+	} else if err := os.WriteFile(*outName, []byte(out), 0644); err != nil {
+		return errors.New(fmt.Sprintf("cannot write the file: %s", err))
+	}
+	if err := recompile(fixed, fileName); err != nil {
+		return errors.New(fmt.Sprintf("the fixed program still has errors: %s", err))
+	}
+	return nil
+}
+
+// 修正したプログラム fixed をコンパイルし直し、エラーがあればエラーを返す
+// import を同じように読むため、一時ファイルはソース fileName と同じディレクトリに置く
+func recompile(fixed string, fileName string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "fix-*"+filepath.Ext(fileName))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name() + ".tex")
+	_, err = tmp.WriteString(fixed)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	tex, scanner, err := getsource.OpenSource(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer tex.Close()
+	_, err = compile.Compile(tex, scanner)
+	return err
+}
+
+// xref: 名前の宣言と使用の位置をブロックごとに一覧にする、 -at 行:桁 ならその位置の名前だけ
+func xref(args []string) error {
+	flags := flag.NewFlagSet("xref", flag.ExitOnError)
+	at := flags.String("at", "", "この位置 (行:桁) の名前を出力")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("invalid argument length")
+	}
+	var p getsource.Pos
+	if *at != "" {
+		if _, err := fmt.Sscanf(*at, "%d:%d", &p.Line, &p.Col); err != nil {
+			return errors.New(fmt.Sprintf("invalid position: %s", *at))
+		}
+		p.Col-- // 桁は 1 から
+	}
+	fileName := flags.Arg(0)
+	tex, scanner, err := getsource.OpenSource(fileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot open the file: %s", err))
+	}
+	defer tex.Close()
+	if _, err := compile.Compile(tex, scanner); err != nil {
+		fmt.Fprintln(os.Stderr, err) // エラーの数
+	}
+	if *at == "" {
+		table.WriteXref(os.Stdout)
+		return nil
+	}
+	sym := table.Root().SymbolAt(fileName, p)
+	if sym == nil {
+		return errors.New(fmt.Sprintf("no name at %s", *at))
+	}
+	fmt.Printf("%s %s %s (%s:%d:%d, %s)\n", sym.Name, sym.Kind, sym.Type, sym.File, sym.Pos.Line, sym.Pos.Col+1, sym.Scope.Name())
+	return nil
+}
+
+// disasm: 目的プログラムを命令語ごとに出力する、 -src ならソースの行を挟む
+func disasm(args []string) error {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	frameName := flags.String("frame", "display", "外側のブロックの変数のたどり方 (display か static)")
+	src := flags.Bool("src", false, "命令語を生成したソースの行を挟む")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("invalid argument length")
+	}
+	if err := setFrame(*frameName); err != nil {
+		return err
+	}
+	prog, err := load(flags.Arg(0), io.Discard)
+	if err != nil {
+		return err
+	}
+	codegen.Disasm(os.Stdout, prog, *src)
+	return nil
+}
+
+// asm: アセンブラ (.pl0s) をアセンブルして目的プログラムをファイル (.pl0c) に書き出す
+func asm(args []string) error {
+	flags := flag.NewFlagSet("asm", flag.ExitOnError)
+	outName := flags.String("o", "", "出力ファイル (省略時は拡張子を .pl0c にしたもの)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("invalid argument length")
+	}
+	fileName := flags.Arg(0)
+	src, err := os.Open(fileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot open the file: %s", err))
+	}
+	defer src.Close()
+	prog, err := codegen.Assemble(src, fileName)
+	if err != nil {
+		return err
 	}
+	return writeProgram(prog, fileName, *outName, true)
 }
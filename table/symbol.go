@@ -0,0 +1,119 @@
+package table
+
+import (
+	"github.com/is-hoku/pl0dash-go/getsource"
+)
+
+// 名前表の名前、コンパイルが終わってもそのまま残る
+type Symbol struct {
+	Name     string            // 名前のつづり (import した名前は lib.name)
+	Kind     getsource.KindT   // 名前の種類
+	Type     getsource.TypeT   // 値の型 (関数は結果の型、配列は要素の型)
+	Addr     getsource.RelAddr // 変数・パラメタ・配列の番地、関数の先頭番地 (参照渡しのパラメタは変数の番地が入るところ)
+	Value    int               // 定数の値
+	Params   []*Symbol         // 関数のパラメタ (宣言順)
+	Fwd      bool              // 関数が forward 宣言だけで本体がまだない
+	Low      int               // 配列の添字の下限
+	Size     int               // 配列の要素数
+	File     string            // 宣言したソースファイルの名前
+	Pos      getsource.Pos     // 宣言の位置
+	Uses     []getsource.Use   // 名前の使用 (出てきた順)
+	Scope    *Scope            // 宣言した有効範囲
+	Body     *Scope            // 関数のブロックの有効範囲
+	spelling string            // 宣言でのつづり
+	index    int               // 名前表のインデックス
+}
+
+// 名前の有効範囲、主ブロック、関数のブロック、 import したファイルの名前空間のどれか
+type Scope struct {
+	Func     *Symbol       // 関数のブロックならその関数名
+	Level    int           // ブロックレベル
+	File     string        // ソースファイルの名前
+	Import   bool          // import したファイルの名前空間 (これより外の名前は見えない)
+	Parent   *Scope        // 外側の有効範囲、主ブロックは nil
+	Children []*Scope      // 内側の有効範囲 (始まった順)
+	Symbols  []*Symbol     // 宣言した名前 (宣言順)
+	Start    getsource.Pos // ソースでの始まりの位置
+	End      getsource.Pos // ソースでの終わりの位置 (最後のトークンの直後)
+
+	prefix    string             // 名前空間の名前
+	names     map[string]*Symbol // 見える名前 (import した名前は lib.name で入る)
+	localAddr int                // このブロックの最後の変数の番地
+}
+
+var root *Scope // 最後にコンパイルを始めたプログラムの主ブロック
+
+// 最後にコンパイルを始めたプログラムの主ブロックを返す
+// 次のコンパイルが始まると新しい主ブロックに変わるが、前に返した有効範囲は書き換えない
+func Root() *Scope {
+	return root
+}
+
+// 有効範囲の名前、関数のブロックはその関数名
+func (s *Scope) Name() string {
+	switch {
+	case s.Import:
+		return s.prefix
+	case s.Func != nil:
+		return s.Func.Name
+	default:
+		return "main"
+	}
+}
+
+// 有効範囲 s から見える名前 id を内側から探す、なければ nil
+func (s *Scope) Lookup(id string) *Symbol {
+	for ; s != nil; s = s.Parent {
+		if sym, ok := s.names[id]; ok {
+			return sym
+		}
+		if s.Import {
+			break
+		}
+	}
+	return nil
+}
+
+// ファイル file の位置 p を含む一番内側の有効範囲を返す、 s の外なら nil
+func (s *Scope) ScopeAt(file string, p getsource.Pos) *Scope {
+	for _, c := range s.Children { // import した名前空間は別のファイルなので外でも探す
+		if in := c.ScopeAt(file, p); in != nil {
+			return in
+		}
+	}
+	if s.File == file && within(p, s.Start, s.End) {
+		return s
+	}
+	return nil
+}
+
+// ファイル file の位置 p で宣言または使用している名前を s とその内側から探す、なければ nil
+func (s *Scope) SymbolAt(file string, p getsource.Pos) *Symbol {
+	for _, sym := range s.Symbols {
+		end := getsource.Pos{Line: sym.Pos.Line, Col: sym.Pos.Col + len(sym.spelling)}
+		if sym.File == file && within(p, sym.Pos, end) {
+			return sym
+		}
+		for _, u := range sym.Uses {
+			if u.File == file && within(p, u.Pos, u.End) {
+				return sym
+			}
+		}
+	}
+	for _, c := range s.Children {
+		if sym := c.SymbolAt(file, p); sym != nil {
+			return sym
+		}
+	}
+	return nil
+}
+
+// 位置 p は q より前か？
+func before(p getsource.Pos, q getsource.Pos) bool {
+	return p.Line < q.Line || (p.Line == q.Line && p.Col < q.Col)
+}
+
+// 位置 p は [start, end) の中か？
+func within(p getsource.Pos, start getsource.Pos, end getsource.Pos) bool {
+	return !before(p, start) && before(p, end)
+}
@@ -1,51 +1,87 @@
 package table
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/is-hoku/pl0dash-go/getsource"
 )
 
-const MAXLEVEL int = 5   // ブロックの最大深さ
-const MAXTABLE int = 100 // 名前表の最大長さ
-
-var nameTable [MAXTABLE]getsource.TableE // 名前表
-var tIndex int = 0                       // 名前表のインデックス
-var level int = -1                       // 現在のブロックレベル
-var index [MAXLEVEL]int                  // index[i] にはブロックレベル i の最後のインデックス
-var addr [MAXLEVEL]int                   // addr[i] にはブロックレベル i の最後の変数の番地
-var tfIndex int                          // 名前表の関数を保持しているインデックス (一時)
-var localAddr int                        // 現在のブロックの最後の変数の番地
+var nameTable = []*Symbol{{}} // 名前表、 [0] は主ブロックの関数名 (ダミー)
+var scopes []*Scope           // 有効範囲のスタック (内側のものが最後)
+var level int = -1            // 現在のブロックレベル
+var tfIndex int               // 名前表の関数を保持しているインデックス (一時)
+var floor int                 // 名前表のこのインデックスまでの名前は今の名前空間のものではない
 // 引数付き関数は引数、関数、関数内の変数の順番で実行時にスタックされるため、ブロックのデータ領域には退避領域、 RetAdr, a, b, c の順でスタックされることを考慮すると top (スタックの最後尾)  が指すところから 2 番地目から変数がある
 
+// 現在の有効範囲
+func cur() *Scope {
+	return scopes[len(scopes)-1]
+}
+
+// 名前表の最後のインデックス
+func last() int {
+	return len(nameTable) - 1
+}
+
+// コンパイルの始まりで呼ばれる、前のコンパイルが途中で終わっていても主ブロックから始める
+func Reset() {
+	level = -1
+}
+
 // ブロックの始まり (最初の変数の番地) で呼ばれる
 func BlockBegin(firstAddr int, fptex *os.File) {
-	if level == -1 { // 主ブロックの初期設定
-		localAddr = firstAddr
-		tIndex = 0
-		level++
+	level++
+	if level == 0 { // 主ブロックの初期設定、名前表と有効範囲は作り直す (前のコンパイルの有効範囲は書き換えない)
+		nameTable = []*Symbol{{}}
+		scopes = nil
+		floor = 0
+		tfIndex = 0
+		root = newScope(&Scope{Level: level, localAddr: firstAddr})
 		return
 	}
-	if level == MAXLEVEL-1 {
-		getsource.ErrorF("too many nested blocks", fptex)
+	f := nameTable[tfIndex]
+	if f.Body != nil { // forward 宣言した関数の本体は、宣言のときの有効範囲を使い直す
+		reopenScope(f.Body, firstAddr)
+		return
+	}
+	f.Body = newScope(&Scope{Func: f, Level: level, localAddr: firstAddr})
+}
+
+// forward 宣言のときの有効範囲 s を本体の有効範囲にする、名前は本体のパラメタから入れ直す
+func reopenScope(s *Scope, firstAddr int) {
+	for i, c := range s.Parent.Children { // 外側の有効範囲の中では本体の位置に並べる
+		if c == s {
+			s.Parent.Children = append(s.Parent.Children[:i], s.Parent.Children[i+1:]...)
+			break
+		}
+	}
+	s.Parent.Children = append(s.Parent.Children, s)
+	s.Symbols = nil
+	s.names = make(map[string]*Symbol)
+	s.Start = getsource.TokenPos()
+	s.localAddr = firstAddr
+	scopes = append(scopes, s)
+}
+
+// 新しい有効範囲に入る
+func newScope(s *Scope) *Scope {
+	s.File = getsource.FileName()
+	s.Start = getsource.TokenPos()
+	s.names = make(map[string]*Symbol)
+	if len(scopes) > 0 {
+		s.Parent = cur()
+		s.Parent.Children = append(s.Parent.Children, s)
 	}
-	index[level] = tIndex // 今までのブロックの情報を格納
-	addr[level] = localAddr
-	localAddr = firstAddr // 新しいブロックの最初の変数の番地
-	level++               // 新しいブロックのレベル
-	return
+	scopes = append(scopes, s)
+	return s
 }
 
 // ブロックの終わりで呼ばれる
 func BlockEnd() {
-	if level == 0 {
-		tIndex = 0
-		localAddr = 0
-		return
-	}
+	cur().End = getsource.PrevEnd()
+	scopes = scopes[:len(scopes)-1] // 一つ外側のブロックの情報を回復
 	level--
-	tIndex = index[level] // 一つ外側のブロックの情報を回復
-	localAddr = addr[level]
 }
 
 // 現ブロックのレベルを返す
@@ -53,93 +89,331 @@ func BLevel() int {
 	return level
 }
 
+// 現ブロックの関数の名前表の名前、主ブロックと名前空間の外は nil
+func curFunc() *Symbol {
+	for d := len(scopes) - 1; d >= 0; d-- {
+		if f := scopes[d].Func; f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
 // 現ブロックの関数のパラメタ数を返す
 func FPars() int {
-	if level == 0 {
-		return 0 // 主ブロックにはパラメタがない
+	if f := curFunc(); f != nil {
+		return len(f.Params)
+	}
+	return 0 // 主ブロックにはパラメタがない
+}
+
+// 現ブロックの関数の種類 (関数か手続きか) を返す
+func FKind() getsource.KindT {
+	if f := curFunc(); f != nil {
+		return f.Kind
 	}
-	return nameTable[index[level-1]].U.F.Pars
+	return getsource.FuncID // 主ブロックはこれまでどおり値を返せる
 }
 
-func enterT(id string, fptex *os.File) { // 名前表に名前を登録
-	if tIndex < MAXTABLE {
-		tIndex++
-		nameTable[tIndex].Name = id
+// 現ブロックの関数の結果の型を返す
+func FType() getsource.TypeT {
+	if f := curFunc(); f != nil {
+		return f.Type
+	}
+	return getsource.IntType
+}
+
+// 名前 id を内側の有効範囲から探す、見えるのは今の名前空間の名前だけ
+// 見つかればそのインデックスと有効範囲の深さ (現在の有効範囲が 0) を返す
+func lookup(id string) (int, int, bool) {
+	for d := len(scopes) - 1; d >= 0; d-- {
+		if sym, ok := scopes[d].names[id]; ok {
+			return sym.index, len(scopes) - 1 - d, true
+		}
+		if scopes[d].Import {
+			break
+		}
+	}
+	return 0, 0, false
+}
+
+// 名前の宣言のチェック
+// 同じブロックでの二重宣言はエラー、外側の名前や関数のパラメタを隠す宣言は警告
+func checkDecl(id string, k getsource.KindT, fptex *os.File) {
+	i, depth, ok := lookup(id)
+	if !ok {
+		return
+	}
+	if depth > 0 { // 外側のブロックの名前
+		getsource.WarningMessage(fmt.Sprintf("shadow\\ %s\\ %s", nameTable[i].Kind, id), fptex)
+	} else if isPar(nameTable[i].Kind) && !isPar(k) { // 関数のパラメタ
+		getsource.WarningMessage(fmt.Sprintf("shadow\\ par\\ %s", id), fptex)
+	} else {
+		getsource.ErrorMessage(fmt.Sprintf("dup\\ %s", id), fptex)
+	}
+}
+
+// 種類 k はパラメタか？
+func isPar(k getsource.KindT) bool {
+	return k == getsource.ParID || k == getsource.RefID
+}
+
+// 名前表に名前を登録、宣言の位置は現トークンの位置 (違えば SetPos で直す)
+func enterT(id string, k getsource.KindT, fptex *os.File) int {
+	checkDecl(id, k, fptex)
+	sym := &Symbol{Name: id, Kind: k, File: getsource.FileName(), Pos: getsource.TokenPos(), Scope: cur(), spelling: id, index: len(nameTable)} // 型は整数
+	sym.Addr.Level = level
+	nameTable = append(nameTable, sym)
+	cur().names[id] = sym
+	cur().Symbols = append(cur().Symbols, sym)
+	return sym.index
+}
+
+// 名前表 [ti] の宣言の位置を p にする
+func SetPos(ti int, p getsource.Pos) {
+	nameTable[ti].Pos = p
+}
+
+// 名前表 [ti] の名前の使用を記録する
+func addUse(ti int, u getsource.UseKind) {
+	nameTable[ti].Uses = append(nameTable[ti].Uses, getsource.Use{File: getsource.FileName(), Pos: getsource.TokenPos(), End: getsource.TokenEnd(), Kind: u})
+}
+
+// 名前表 [ti] の最後の使用を書き込みにしてその番号を返す (SearchT は値の参照として記録する)
+// 書き込む値の型は SetUseType で後から決める
+func MarkWrite(ti int) int {
+	uses := nameTable[ti].Uses
+	if len(uses) == 0 {
+		return -1
+	}
+	uses[len(uses)-1].Kind = getsource.WriteUse
+	return len(uses) - 1
+}
+
+// 名前表 [ti] の u 番目の使用 (書き込み) で書き込む値の型を t にし、名前の型と同じかを調べる
+// エラーは書き込んだところに出す、まだ名前を読んでいなければ名前に、式の後ならそこに付ける
+func SetUseType(ti int, u int, t getsource.TypeT, fptex *os.File) {
+	if u < 0 {
+		return
+	}
+	sym := nameTable[ti]
+	sym.Uses[u].Type = t
+	switch sym.Kind {
+	case getsource.VarID, getsource.ParID, getsource.RefID, getsource.ArrayID:
+	default: // 書き込めない名前は書き込んだところでエラーにしている
+		return
+	}
+	if t == getsource.NoType || sym.Type == getsource.NoType || t == sym.Type {
+		return
+	}
+	m := fmt.Sprintf("%s\\ %s,\\ not\\ %s", sym.Name, t, sym.Type)
+	if getsource.TokenPos() == sym.Uses[u].Pos {
+		getsource.ErrorType(m, fptex)
 	} else {
-		getsource.ErrorF("too many names", fptex)
+		getsource.ErrorMessage(m, fptex)
 	}
 }
 
 // 名前表に関数名と先頭番地を登録
 func EnterTfunc(id string, v int, fptex *os.File) int {
-	enterT(id, fptex)
-	nameTable[tIndex].Kind = getsource.FuncID
-	nameTable[tIndex].U.F.Raddr.Level = level
-	nameTable[tIndex].U.F.Raddr.Addr = v // 関数の先頭番地 (目的コード)
-	nameTable[tIndex].U.F.Pars = 0       // パラメタ数の初期値
-	tfIndex = tIndex                     // 関数名のインデックスを一時保持
-	return tIndex
+	ti := enterT(id, getsource.FuncID, fptex)
+	nameTable[ti].Addr.Addr = v // 関数の先頭番地 (目的コード)
+	tfIndex = ti                // 関数名のインデックスを一時保持
+	return ti
+}
+
+// 名前表に手続き名と先頭番地を登録
+func EnterTproc(id string, v int, fptex *os.File) int {
+	ti := EnterTfunc(id, v, fptex)
+	nameTable[ti].Kind = getsource.ProcID
+	nameTable[ti].Type = getsource.NoType // 手続きは値を返さない
+	return ti
+}
+
+// forward 宣言した関数の本体の宣言の始まりで呼ばれる
+// パラメタを登録し直すため、宣言済みの各パラメタが参照渡しかとその型を返してパラメタをなくす
+func ResumeTfunc(ti int) ([]bool, []getsource.TypeT) {
+	f := nameTable[ti]
+	refs := make([]bool, len(f.Params))
+	types := make([]getsource.TypeT, len(f.Params))
+	for i, p := range f.Params {
+		refs[i] = p.Kind == getsource.RefID
+		types[i] = p.Type
+	}
+	f.Params = nil
+	f.Fwd = false
+	tfIndex = ti
+	return refs, types
+}
+
+// 名前表 [ti] の関数を forward 宣言だけのものにする
+func SetFwd(ti int) {
+	nameTable[ti].Fwd = true
+}
+
+// 名前表 [ti] の関数は forward 宣言だけで本体がまだないか？
+func IsFwd(ti int) bool {
+	return (nameTable[ti].Kind == getsource.FuncID || nameTable[ti].Kind == getsource.ProcID) && nameTable[ti].Fwd
+}
+
+// 現ブロックで forward 宣言された関数名を探す、なければ 0 を返す
+func SearchFwd(id string) int {
+	if i, depth, ok := lookup(id); ok && depth == 0 && IsFwd(i) {
+		return i
+	}
+	return 0
 }
 
 // 名前表にパラメタ名を登録
 func EnterTpar(id string, fptex *os.File) int {
-	enterT(id, fptex)
-	nameTable[tIndex].Kind = getsource.ParID
-	nameTable[tIndex].U.Raddr.Level = level
-	nameTable[tfIndex].U.F.Pars++ // 関数のパラメタ数のカウント
-	return tIndex
+	ti := enterT(id, getsource.ParID, fptex)
+	nameTable[tfIndex].Params = append(nameTable[tfIndex].Params, nameTable[ti]) // 関数のパラメタ
+	return ti
+}
+
+// 名前表に参照渡しのパラメタ名を登録
+func EnterTref(id string, fptex *os.File) int {
+	ti := enterT(id, getsource.RefID, fptex)
+	nameTable[tfIndex].Params = append(nameTable[tfIndex].Params, nameTable[ti]) // 関数のパラメタ
+	return ti
 }
 
 // 名前表に変数名を登録
 func EnterTvar(id string, fptex *os.File) int {
-	enterT(id, fptex)
-	nameTable[tIndex].Kind = getsource.VarID
-	nameTable[tIndex].U.Raddr.Level = level
-	nameTable[tIndex].U.Raddr.Addr = localAddr // localAddr はブロックの最初の変数の番地 (はじめは 2)
-	localAddr++
-	return tIndex
+	ti := enterT(id, getsource.VarID, fptex)
+	nameTable[ti].Addr.Addr = cur().localAddr // localAddr はブロックの最初の変数の番地 (はじめは 2)
+	cur().localAddr++
+	return ti
+}
+
+// 名前表に配列名を登録、要素の分だけ番地を取る
+func EnterTarray(id string, low int, size int, fptex *os.File) int {
+	ti := enterT(id, getsource.ArrayID, fptex)
+	nameTable[ti].Addr.Addr = cur().localAddr // 先頭の要素の番地
+	nameTable[ti].Low = low
+	nameTable[ti].Size = size
+	cur().localAddr += size
+	return ti
 }
 
 // 名前表に定数名とその値を登録
 func EnterTconst(id string, v int, fptex *os.File) int {
-	enterT(id, fptex)
-	nameTable[tIndex].Kind = getsource.ConstID
-	nameTable[tIndex].U.Value = v
-	return tIndex
+	ti := enterT(id, getsource.ConstID, fptex)
+	nameTable[ti].Value = v
+	return ti
 }
 
 // パラメタ宣言部の最後で呼ばれる
 func Endpar() {
-	pars := nameTable[tfIndex].U.F.Pars // 関数のパラメタ数
-	if pars == 0 {
-		return
+	pars := nameTable[tfIndex].Params
+	for i, p := range pars { // 各パラメタの番地を求める
+		p.Addr.Addr = i - len(pars)
+	}
+}
+
+// 名前表 [ti] の型を t にする
+func SetType(ti int, t getsource.TypeT) {
+	nameTable[ti].Type = t
+}
+
+// import したファイルのコンパイルの始まりで呼ばれる
+// それまでの名前を見えなくし、元に戻すための情報を返す
+func BeginNamespace() int {
+	saved := floor
+	floor = last()
+	ns := newScope(&Scope{Level: level, Import: true, localAddr: cur().localAddr})
+	ns.Start = getsource.Pos{Line: 1}
+	return saved
+}
+
+// import したファイルのコンパイルの終わりで呼ばれる
+// そのファイルの主ブロックの名前を prefix.name にして、それまでの名前を見えるように戻す
+// そのファイルの名前空間を返す
+func EndNamespace(prefix string, saved int) *Scope {
+	ns := cur()
+	ns.End = getsource.TokenEnd()
+	ns.prefix = prefix
+	scopes = scopes[:len(scopes)-1]
+	for _, sym := range ns.Symbols {
+		sym.Name = prefix + "." + sym.spelling
 	}
-	for i := 1; i <= pars; i++ { // 各パラメタの番地を求める
-		nameTable[tfIndex+i].U.Raddr.Addr = i - 1 - pars
+	UseNamespace(ns)
+	floor = saved
+	return ns
+}
+
+// import したファイルの名前空間 ns の名前を今の有効範囲で見えるようにする
+// 見えるのはそのファイルで宣言した名前だけで、そのファイルがさらに import した名前は見えない
+func UseNamespace(ns *Scope) {
+	for _, sym := range ns.Symbols {
+		cur().names[sym.Name] = sym
 	}
 }
 
+// 名前空間の始まりのインデックスを返す (これより後の名前がそのファイルのもの)
+func NamespaceStart() int {
+	return floor
+}
+
 // 名前表 [ti] の値 (関数の先頭番地) の変更
 func ChangeV(ti int, newVal int) {
-	nameTable[ti].U.F.Raddr.Addr = newVal
+	nameTable[ti].Addr.Addr = newVal
 }
 
-func SearchT(id string, k getsource.KindT, fptex *os.File) int {
-	var i int
-	nameTable[0].Name = id // 番兵を立てる
-	for i = tIndex; id != nameTable[i].Name; i-- {
+// 名前 id が見えればその種類を返す (使用には数えない)
+func LookupKind(id string) (getsource.KindT, bool) {
+	if i, _, ok := lookup(id); ok {
+		return nameTable[i].Kind, true
 	}
-	if i != 0 { // 名前があった
+	return 0, false
+}
+
+// 名前表から名前を探す、 k はその名前に求める種類
+// 見つけた名前の種類が k に合わなければ、その種類を示すエラー
+func SearchT(id string, k getsource.KindT, fptex *os.File) int {
+	if i, _, ok := lookup(id); ok { // 名前があった
+		if f := nameTable[i].Kind; f == getsource.FuncID || f == getsource.ProcID {
+			addUse(i, getsource.CallUse)
+		} else {
+			addUse(i, getsource.ReadUse)
+		}
+		if !kindMatch(nameTable[i].Kind, k) {
+			getsource.SetIdKind(nameTable[i].Kind) // 印字のための情報セット
+			getsource.ErrorType(fmt.Sprintf("%s,\\ not\\ %s", nameTable[i].Kind, k), fptex)
+		}
 		return i
 	} else { // 名前がなかった
 		getsource.ErrorType("undef", fptex)
 		if k == getsource.VarID {
-			return EnterTvar(id, fptex) // 変数名の時は仮登録
+			ti := EnterTvar(id, fptex) // 変数名の時は仮登録
+			nameTable[ti].Type = getsource.NoType
+			addUse(ti, getsource.ReadUse)
+			return ti
 		}
 		return 0
 	}
 }
 
+// 種類 t の名前は種類 k を求めるところに書けるか？
+// VarID は文や式の中の名前で、どの種類でもよい (使い方は呼び出し側で調べる)
+func kindMatch(t getsource.KindT, k getsource.KindT) bool {
+	switch k {
+	case getsource.ConstID:
+		return t == getsource.ConstID
+	case getsource.FuncID:
+		return t == getsource.FuncID
+	case getsource.ProcID: // call 文では関数も呼べる
+		return t == getsource.ProcID || t == getsource.FuncID
+	default:
+		return true
+	}
+}
+
+// 名前表 [i] の名前を返す
+func RetName(i int) string {
+	return nameTable[i].Name
+}
+
 // 名前表 [i] の種類を返す
 func RetKindT(i int) getsource.KindT {
 	return nameTable[i].Kind
@@ -147,31 +421,50 @@ func RetKindT(i int) getsource.KindT {
 
 // 名前表 [ti] のアドレスを返す
 func RetRelAddr(ti int) getsource.RelAddr {
-	switch nameTable[ti].Kind {
-	case getsource.VarID:
-		return nameTable[ti].U.Raddr
-	case getsource.FuncID:
-		return nameTable[ti].U.F.Raddr
-	case getsource.ParID:
-		return nameTable[ti].U.Raddr
-	case getsource.ConstID:
-		return nameTable[ti].U.Raddr
-	default:
-		return nameTable[ti].U.Raddr
-	}
+	return nameTable[ti].Addr
+}
+
+// 名前表 [ti] の型を返す
+func RetType(ti int) getsource.TypeT {
+	return nameTable[ti].Type
 }
 
 // 名前表 [ti] の value を返す
 func RetVal(ti int) int {
-	return nameTable[ti].U.Value
+	return nameTable[ti].Value
 }
 
-// 名前表 [ti] の関数のパラメタ数を返す
+// 名前表 [ti] の関数・手続きのパラメタ数を返す
 func RetPars(ti int) int {
-	return nameTable[ti].U.F.Pars
+	return len(nameTable[ti].Params)
+}
+
+// 名前表 [ti] の関数の i 番目 (0 から) のパラメタは参照渡しか？
+func IsRef(ti int, i int) bool {
+	pars := nameTable[ti].Params
+	return i < len(pars) && pars[i].Kind == getsource.RefID
+}
+
+// 名前表 [ti] の関数の i 番目 (0 から) のパラメタの型を返す
+func RetParType(ti int, i int) getsource.TypeT {
+	pars := nameTable[ti].Params
+	if i < len(pars) {
+		return pars[i].Type
+	}
+	return getsource.NoType // 余分な実引数
+}
+
+// 名前表 [ti] の配列の添字の下限を返す
+func RetLow(ti int) int {
+	return nameTable[ti].Low
+}
+
+// 名前表 [ti] の配列の要素数を返す
+func RetSize(ti int) int {
+	return nameTable[ti].Size
 }
 
 // そのブロックで実行時に必要とするメモリ容量
 func RetFrameL() int {
-	return localAddr
+	return cur().localAddr
 }
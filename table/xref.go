@@ -0,0 +1,72 @@
+package table
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/is-hoku/pl0dash-go/getsource"
+)
+
+// 相互参照表を w に出力する
+// 有効範囲ごとに、宣言した名前の種類、レベル、番地か値、宣言の位置と使用の位置を並べる
+func WriteXref(w io.Writer) {
+	if root != nil {
+		writeScope(w, root)
+	}
+}
+
+// 有効範囲 s とその内側の相互参照表を始まった順に出力する
+func writeScope(w io.Writer, s *Scope) {
+	fmt.Fprintf(w, "%s (level %d, %s)\n", s.Name(), s.Level, s.File)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, sym := range s.Symbols {
+		fmt.Fprintf(tw, "  %s\t%s\t%d\t%s\t%s\t%s\n", sym.Name, sym.Kind, sym.Addr.Level, addrOrValue(sym), posString(sym.Pos), usesString(sym.Uses, s.File))
+	}
+	tw.Flush()
+	for _, c := range s.Children {
+		writeScope(w, c)
+	}
+}
+
+// 名前の番地か値
+func addrOrValue(sym *Symbol) string {
+	switch sym.Kind {
+	case getsource.ConstID:
+		return fmt.Sprintf("value %d", sym.Value)
+	case getsource.FuncID, getsource.ProcID:
+		return fmt.Sprintf("code %d", sym.Addr.Addr)
+	case getsource.ArrayID:
+		return fmt.Sprintf("addr %d[%d]", sym.Addr.Addr, sym.Size)
+	default:
+		return fmt.Sprintf("addr %d", sym.Addr.Addr)
+	}
+}
+
+// 位置 行:桁 (桁も 1 から)
+func posString(p getsource.Pos) string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col+1)
+}
+
+// 使用の位置を使い方ごとにまとめる、 file 以外のファイルでの使用はファイル名も付ける
+func usesString(uses []getsource.Use, file string) string {
+	var parts []string
+	for _, k := range []getsource.UseKind{getsource.ReadUse, getsource.WriteUse, getsource.CallUse} {
+		var ps []string
+		for _, u := range uses {
+			if u.Kind != k {
+				continue
+			}
+			if u.File != file {
+				ps = append(ps, u.File+":"+posString(u.Pos))
+			} else {
+				ps = append(ps, posString(u.Pos))
+			}
+		}
+		if len(ps) > 0 {
+			parts = append(parts, k.String()+" "+strings.Join(ps, " "))
+		}
+	}
+	return strings.Join(parts, "  ")
+}